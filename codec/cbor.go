@@ -0,0 +1,71 @@
+package codec
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"reflect"
+)
+
+// same field names as JSON, so both can be documented together
+func encodeCbor(value interface{}) ([]byte, error) {
+	return cbor.Marshal(value)
+}
+
+// the library cannot reject unknown fields itself, so the keys are checked level by level
+func decodeCbor(payload []byte) (Batch, bool, error) {
+	keys := map[string]cbor.RawMessage{}
+	if err := cbor.Unmarshal(payload, &keys); err != nil {
+		return Batch{}, false, err
+	}
+	if _, ok := keys["Readings"]; ok {
+		if err := checkCborKeys(keys, Batch{}); err != nil {
+			return Batch{}, true, err
+		}
+		readings := []map[string]cbor.RawMessage{}
+		if err := cbor.Unmarshal(keys["Readings"], &readings); err != nil {
+			return Batch{}, true, err
+		}
+		for _, reading := range readings {
+			if err := checkCborReadingKeys(reading); err != nil {
+				return Batch{}, true, err
+			}
+		}
+		batch := Batch{}
+		return batch, true, cbor.Unmarshal(payload, &batch)
+	}
+
+	if err := checkCborReadingKeys(keys); err != nil {
+		return Batch{}, false, err
+	}
+	reading := Reading{}
+	err := cbor.Unmarshal(payload, &reading)
+	return Batch{Readings: []Reading{reading}}, false, err
+}
+
+func checkCborReadingKeys(keys map[string]cbor.RawMessage) error {
+	if err := checkCborKeys(keys, Reading{}); err != nil {
+		return err
+	}
+	if _, ok := keys["Measurements"]; !ok {
+		return nil
+	}
+	measurements := []map[string]cbor.RawMessage{}
+	if err := cbor.Unmarshal(keys["Measurements"], &measurements); err != nil {
+		return err
+	}
+	for _, measurement := range measurements {
+		if err := checkCborKeys(measurement, Measurement{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkCborKeys(keys map[string]cbor.RawMessage, target interface{}) error {
+	targetType := reflect.TypeOf(target)
+	for key := range keys {
+		if _, ok := targetType.FieldByName(key); !ok {
+			return &UnknownFieldError{Field: key}
+		}
+	}
+	return nil
+}
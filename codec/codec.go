@@ -0,0 +1,242 @@
+// Package codec holds the messages exchanged with the sensor manager and their wire formats.
+// Drivers may send any of the formats, the sensor manager detects them; subscribers choose theirs by topic.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatJson      Format = "json"
+	FormatCbor      Format = "cbor"
+	FormatProtobuf  Format = "protobuf"
+	FormatSenmlJson Format = "senml-json"
+	FormatSenmlCbor Format = "senml-cbor"
+)
+
+var formats = []Format{FormatJson, FormatCbor, FormatProtobuf, FormatSenmlJson, FormatSenmlCbor}
+
+func ParseFormat(name string) (Format, error) {
+	for _, format := range formats {
+		if string(format) == strings.ToLower(strings.TrimSpace(name)) {
+			return format, nil
+		}
+	}
+	names := []string{}
+	for _, format := range formats {
+		names = append(names, string(format))
+	}
+	sort.Strings(names)
+	return "", fmt.Errorf("unknown payload format %s, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// what sensor drivers send
+type Reading struct {
+	// an ID that differentiates this piece of hardware sensor from others
+	SensorId string
+	// the type of the sensor: AM2302 etc
+	SensorType string
+	// the SI dimension (temperature, humidity, weight, etc), one of those in the sensor manager's units.go
+	Quantity string
+	// the timestamp in RFC 3339
+	Timestamp string
+	Value     float64
+	// the unit (deg. celsius, RH%, kg, etc), SI prefixes and common aliases are allowed
+	// it is normalized to the canonical unit of the quantity, with the value converted accordingly
+	Unit string
+	// optional: the hardware model from CIMI the driver was started for, passed in SENSOR_HARDWARE_MODEL
+	HardwareModel string `json:",omitempty"`
+	// optional: several quantities measured at once (AM2302 etc), instead of Quantity, Value and Unit
+	// each one is published on its own topic
+	Measurements []Measurement `json:",omitempty"`
+	// optional: counts the driver's readings of this sensor from 1, so lost ones can be told; not part of SenML records
+	Sequence uint64 `json:",omitempty" cbor:",omitempty"`
+}
+
+// one quantity of a multi-quantity reading, same meaning as in Reading
+type Measurement struct {
+	Quantity string
+	Value    float64
+	Unit     string
+}
+
+// many readings in one message, for drivers publishing at high rates
+type Batch struct {
+	// optional: used for readings without a hardware model
+	HardwareModel string `json:",omitempty"`
+	Readings      []Reading
+}
+
+// what subscribers get; only defines values not known prior to the request
+// e.g. not the sensor type, because this sensor's data has been requested
+type Value struct {
+	Timestamp string
+	Value     float64
+	Unit      string
+	// optional: the value before the sensor's calibration, in the same unit; not part of SenML records
+	RawValue *float64 `json:",omitempty" cbor:",omitempty"`
+	// counts the values of a topic from 1, so subscribers can tell when they missed some; not part of SenML records,
+	// and unset for aggregates and history replays
+	Sequence uint64 `json:",omitempty" cbor:",omitempty"`
+	// only set in v2 envelopes, whose subscribers asked for it; its fields are on the same level as the value's
+	*Provenance
+}
+
+// where a value came from, for subscribers of v2 envelopes; not part of SenML records
+type Provenance struct {
+	// 2
+	Version       int
+	SensorId      string
+	SensorType    string `json:",omitempty" cbor:",omitempty"`
+	Quantity      string
+	HardwareModel string `json:",omitempty" cbor:",omitempty"`
+	// when the sensor manager received the reading, RFC 3339
+	ReceivedAt string
+	// what happened to the value on its way, e.g. calibrated
+	Quality []string `json:",omitempty" cbor:",omitempty"`
+}
+
+// the payload has fields the format does not define, most likely typos of optional fields
+type UnknownFieldError struct {
+	Field string
+}
+
+func (receiver *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %s", receiver.Field)
+}
+
+// binary formats are told apart by their first byte, text formats by their first non-space character:
+// CBOR maps and arrays start with 0xa0-0xbf and 0x80-0x9f, our Protobuf messages with 0x12 or 0x1a (see sensor.proto)
+func Detect(payload []byte) (Format, error) {
+	if len(payload) == 0 {
+		return "", fmt.Errorf("the payload is empty")
+	}
+	switch first := payload[0]; {
+	case first >= 0xa0 && first <= 0xbf:
+		return FormatCbor, nil
+	case first >= 0x80 && first <= 0x9f:
+		return FormatSenmlCbor, nil
+	case first == protobufReadingTag || first == protobufBatchTag:
+		return FormatProtobuf, nil
+	}
+	trimmed := bytes.TrimLeft(payload, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return FormatJson, nil
+	}
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return FormatSenmlJson, nil
+	}
+	return "", fmt.Errorf("the payload format cannot be detected from its first byte 0x%02x", payload[0])
+}
+
+// a single reading is returned as a batch of one; SenML packs are always batches
+func Decode(payload []byte) (format Format, batch Batch, isBatch bool, err error) {
+	format, err = Detect(payload)
+	if err != nil {
+		return "", batch, false, err
+	}
+	switch format {
+	case FormatJson:
+		batch, isBatch, err = decodeJson(payload)
+	case FormatCbor:
+		batch, isBatch, err = decodeCbor(payload)
+	case FormatProtobuf:
+		batch, isBatch, err = decodeProtobuf(payload)
+	case FormatSenmlJson:
+		batch, err = decodeSenmlJson(payload)
+		isBatch = true
+	case FormatSenmlCbor:
+		batch, err = decodeSenmlCbor(payload)
+		isBatch = true
+	}
+	return format, batch, isBatch, err
+}
+
+func decodeJson(payload []byte) (Batch, bool, error) {
+	keys := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &keys); err != nil {
+		return Batch{}, false, err
+	}
+	if _, ok := keys["Readings"]; ok {
+		batch := Batch{}
+		return batch, true, decodeJsonStrict(payload, &batch)
+	}
+	reading := Reading{}
+	err := decodeJsonStrict(payload, &reading)
+	return Batch{Readings: []Reading{reading}}, false, err
+}
+
+func decodeJsonStrict(payload []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(target)
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") {
+		return &UnknownFieldError{Field: strings.TrimPrefix(err.Error(), "json: unknown field ")}
+	}
+	return err
+}
+
+func EncodeReading(format Format, reading Reading) ([]byte, error) {
+	switch format {
+	case FormatJson:
+		return json.Marshal(reading)
+	case FormatCbor:
+		return encodeCbor(reading)
+	case FormatProtobuf:
+		return encodeProtobufReading(reading), nil
+	case FormatSenmlJson, FormatSenmlCbor:
+		return encodeSenmlReadings(format, []Reading{reading})
+	}
+	return nil, fmt.Errorf("unknown payload format %s", format)
+}
+
+func EncodeBatch(format Format, batch Batch) ([]byte, error) {
+	switch format {
+	case FormatJson:
+		return json.Marshal(batch)
+	case FormatCbor:
+		return encodeCbor(batch)
+	case FormatProtobuf:
+		return encodeProtobufBatch(batch), nil
+	case FormatSenmlJson, FormatSenmlCbor:
+		// SenML has no hardware model
+		return encodeSenmlReadings(format, batch.Readings)
+	}
+	return nil, fmt.Errorf("unknown payload format %s", format)
+}
+
+// name is only used by SenML, as record name
+func EncodeValue(format Format, name string, value Value) ([]byte, error) {
+	switch format {
+	case FormatJson:
+		return json.Marshal(value)
+	case FormatCbor:
+		return encodeCbor(value)
+	case FormatProtobuf:
+		return encodeProtobufValue(value), nil
+	case FormatSenmlJson, FormatSenmlCbor:
+		return encodeSenmlValues(format, name, []Value{value})
+	}
+	return nil, fmt.Errorf("unknown payload format %s", format)
+}
+
+// name is only used by SenML, as record name
+func EncodeValues(format Format, name string, values []Value) ([]byte, error) {
+	switch format {
+	case FormatJson:
+		return json.Marshal(values)
+	case FormatCbor:
+		return encodeCbor(values)
+	case FormatProtobuf:
+		return encodeProtobufValues(values), nil
+	case FormatSenmlJson, FormatSenmlCbor:
+		return encodeSenmlValues(format, name, values)
+	}
+	return nil, fmt.Errorf("unknown payload format %s", format)
+}
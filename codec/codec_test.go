@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testReading() Reading {
+	return Reading{
+		SensorId:      "sensor-1",
+		SensorType:    "AM2302",
+		Quantity:      "temperature",
+		Timestamp:     "2020-09-13T12:26:40Z",
+		Value:         21.5,
+		Unit:          "°C",
+		HardwareModel: "raspberry-pi",
+		Sequence:      7,
+	}
+}
+
+func testBatch() Batch {
+	multi := testReading()
+	multi.Quantity, multi.Value, multi.Unit = "", 0, ""
+	multi.Measurements = []Measurement{{Quantity: "temperature", Value: 21.5, Unit: "°C"}, {Quantity: "humidity", Value: 40, Unit: "%RH"}}
+	return Batch{HardwareModel: "raspberry-pi", Readings: []Reading{testReading(), multi}}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		payload string
+		format  Format
+	}{
+		{`{"SensorId":"sensor-1"}`, FormatJson},
+		{" \r\n\t{}", FormatJson},
+		{`[{"n":"sensor-1:temperature","v":1}]`, FormatSenmlJson},
+		{"\n[]", FormatSenmlJson},
+		{"\xa1\x61a\x01", FormatCbor},
+		{"\xbf\xff", FormatCbor},
+		{"\x81\xa0", FormatSenmlCbor},
+		{"\x9f\xff", FormatSenmlCbor},
+		{"\x12\x00", FormatProtobuf},
+		{"\x1a\x00", FormatProtobuf},
+	}
+	for _, test := range tests {
+		format, err := Detect([]byte(test.payload))
+		if err != nil || format != test.format {
+			t.Errorf("Detect(%q) = %s, %v, want %s", test.payload, format, err, test.format)
+		}
+	}
+	for _, payload := range []string{"", "   ", "\x0a\x00", "sensor-1"} {
+		if format, err := Detect([]byte(payload)); err == nil {
+			t.Errorf("Detect(%q) = %s, want an error", payload, format)
+		}
+	}
+}
+
+// what each encoder produces has to be detected as its own format
+func TestDetectEncoded(t *testing.T) {
+	for _, format := range formats {
+		for name, encode := range map[string]func() ([]byte, error){
+			"reading": func() ([]byte, error) { return EncodeReading(format, testReading()) },
+			"batch":   func() ([]byte, error) { return EncodeBatch(format, testBatch()) },
+		} {
+			payload, err := encode()
+			if err != nil {
+				t.Fatalf("encoding a %s as %s: %v", name, format, err)
+			}
+			if detected, err := Detect(payload); err != nil || detected != format {
+				t.Errorf("a %s encoded as %s is detected as %s, %v", name, format, detected, err)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatJson, FormatCbor, FormatProtobuf} {
+		payload, err := EncodeReading(format, testReading())
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		decodedFormat, batch, isBatch, err := Decode(payload)
+		if err != nil || decodedFormat != format || isBatch {
+			t.Errorf("%s: decoding a reading gives %s, batch %t, %v", format, decodedFormat, isBatch, err)
+		}
+		if want := []Reading{testReading()}; !reflect.DeepEqual(batch.Readings, want) {
+			t.Errorf("%s: reading round trip gives %+v, want %+v", format, batch.Readings, want)
+		}
+
+		payload, err = EncodeBatch(format, testBatch())
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		decodedFormat, batch, isBatch, err = Decode(payload)
+		if err != nil || decodedFormat != format || !isBatch {
+			t.Errorf("%s: decoding a batch gives %s, batch %t, %v", format, decodedFormat, isBatch, err)
+		}
+		if want := testBatch(); !reflect.DeepEqual(batch, want) {
+			t.Errorf("%s: batch round trip gives %+v, want %+v", format, batch, want)
+		}
+	}
+}
+
+func TestDecodeUnknownField(t *testing.T) {
+	cborTypo, err := encodeCbor(map[string]interface{}{"SensorId": "sensor-1", "Quantity": "temperature", "Sequnce": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cborNestedTypo, err := encodeCbor(map[string]interface{}{"Readings": []interface{}{map[string]interface{}{
+		"SensorId": "sensor-1", "Measurements": []interface{}{map[string]interface{}{"Quantity": "humidity", "Vaule": 1}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		payload []byte
+		field   string
+	}{
+		// the JSON decoder quotes the name
+		{[]byte(`{"SensorId":"sensor-1","Quantity":"temperature","Sequnce":1}`), `"Sequnce"`},
+		{[]byte(`{"Readings":[{"SensorId":"sensor-1","Measurements":[{"Quantity":"humidity","Vaule":1}]}]}`), `"Vaule"`},
+		{cborTypo, "Sequnce"},
+		{cborNestedTypo, "Vaule"},
+	}
+	for _, test := range tests {
+		format, _, _, err := Decode(test.payload)
+		if unknown, ok := err.(*UnknownFieldError); !ok || unknown.Field != test.field {
+			t.Errorf("%s: decoding a typo gives %v, want an unknown field error for %s", format, err, test.field)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if format, err := ParseFormat(" SenML-CBOR "); err != nil || format != FormatSenmlCbor {
+		t.Errorf("ParseFormat gives %s, %v, want %s", format, err, FormatSenmlCbor)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat accepts xml")
+	}
+}
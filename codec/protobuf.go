@@ -0,0 +1,269 @@
+package codec
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// the first bytes of SensorPayload in sensor.proto: field 2 or 3, length delimited
+const protobufReadingTag = 0x12
+const protobufBatchTag = 0x1a
+
+func appendProtobufString(b []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendProtobufDouble(b []byte, number protowire.Number, value float64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(value))
+}
+
+func appendProtobufVarint(b []byte, number protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendProtobufMessage(b []byte, number protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func encodeProtobufMeasurement(measurement Measurement) []byte {
+	b := appendProtobufString(nil, 1, measurement.Quantity)
+	b = appendProtobufDouble(b, 2, measurement.Value)
+	return appendProtobufString(b, 3, measurement.Unit)
+}
+
+func encodeProtobufReadingMessage(reading Reading) []byte {
+	b := appendProtobufString(nil, 1, reading.SensorId)
+	b = appendProtobufString(b, 2, reading.SensorType)
+	b = appendProtobufString(b, 3, reading.Quantity)
+	b = appendProtobufString(b, 4, reading.Timestamp)
+	b = appendProtobufDouble(b, 5, reading.Value)
+	b = appendProtobufString(b, 6, reading.Unit)
+	b = appendProtobufString(b, 7, reading.HardwareModel)
+	for _, measurement := range reading.Measurements {
+		b = appendProtobufMessage(b, 8, encodeProtobufMeasurement(measurement))
+	}
+	b = appendProtobufVarint(b, 9, reading.Sequence)
+	return b
+}
+
+func encodeProtobufReading(reading Reading) []byte {
+	return appendProtobufMessage(nil, 2, encodeProtobufReadingMessage(reading))
+}
+
+func encodeProtobufBatch(batch Batch) []byte {
+	b := appendProtobufString(nil, 1, batch.HardwareModel)
+	for _, reading := range batch.Readings {
+		b = appendProtobufMessage(b, 2, encodeProtobufReadingMessage(reading))
+	}
+	return appendProtobufMessage(nil, 3, b)
+}
+
+func encodeProtobufValue(value Value) []byte {
+	b := appendProtobufString(nil, 1, value.Timestamp)
+	b = appendProtobufDouble(b, 2, value.Value)
+	b = appendProtobufString(b, 3, value.Unit)
+	// set even if zero, it is optional
+	if value.RawValue != nil {
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*value.RawValue))
+	}
+	b = appendProtobufVarint(b, 11, value.Sequence)
+	if provenance := value.Provenance; provenance != nil {
+		b = appendProtobufVarint(b, 5, uint64(provenance.Version))
+		b = appendProtobufString(b, 6, provenance.SensorId)
+		b = appendProtobufString(b, 7, provenance.SensorType)
+		b = appendProtobufString(b, 8, provenance.Quantity)
+		b = appendProtobufString(b, 9, provenance.HardwareModel)
+		b = appendProtobufString(b, 10, provenance.ReceivedAt)
+		for _, flag := range provenance.Quality {
+			b = appendProtobufString(b, 12, flag)
+		}
+	}
+	return b
+}
+
+func encodeProtobufValues(values []Value) []byte {
+	var b []byte
+	for _, value := range values {
+		b = appendProtobufMessage(b, 1, encodeProtobufValue(value))
+	}
+	return b
+}
+
+// calls handle for every field, skipping those it does not know (handled false)
+func consumeProtobufFields(b []byte, handle func(number protowire.Number, fieldType protowire.Type, b []byte) (n int, handled bool)) error {
+	for len(b) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, handled := handle(number, fieldType, b)
+		if !handled {
+			n = protowire.ConsumeFieldValue(number, fieldType, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeProtobufString(fieldType protowire.Type, b []byte, target *string) (int, bool) {
+	if fieldType != protowire.BytesType {
+		return 0, false
+	}
+	value, n := protowire.ConsumeString(b)
+	*target = value
+	return n, true
+}
+
+func consumeProtobufVarint(fieldType protowire.Type, b []byte, target *uint64) (int, bool) {
+	if fieldType != protowire.VarintType {
+		return 0, false
+	}
+	value, n := protowire.ConsumeVarint(b)
+	*target = value
+	return n, true
+}
+
+func consumeProtobufDouble(fieldType protowire.Type, b []byte, target *float64) (int, bool) {
+	if fieldType != protowire.Fixed64Type {
+		return 0, false
+	}
+	value, n := protowire.ConsumeFixed64(b)
+	*target = math.Float64frombits(value)
+	return n, true
+}
+
+// decodes an embedded message with decode, errors are kept in err
+func consumeProtobufMessage(fieldType protowire.Type, b []byte, decode func([]byte) error, err *error) (int, bool) {
+	if fieldType != protowire.BytesType {
+		return 0, false
+	}
+	message, n := protowire.ConsumeBytes(b)
+	if n >= 0 && *err == nil {
+		*err = decode(message)
+	}
+	return n, true
+}
+
+func decodeProtobufMeasurement(b []byte) (Measurement, error) {
+	measurement := Measurement{}
+	err := consumeProtobufFields(b, func(number protowire.Number, fieldType protowire.Type, b []byte) (int, bool) {
+		switch number {
+		case 1:
+			return consumeProtobufString(fieldType, b, &measurement.Quantity)
+		case 2:
+			return consumeProtobufDouble(fieldType, b, &measurement.Value)
+		case 3:
+			return consumeProtobufString(fieldType, b, &measurement.Unit)
+		}
+		return 0, false
+	})
+	return measurement, err
+}
+
+func decodeProtobufReading(b []byte) (Reading, error) {
+	reading := Reading{}
+	var nestedErr error
+	err := consumeProtobufFields(b, func(number protowire.Number, fieldType protowire.Type, b []byte) (int, bool) {
+		switch number {
+		case 1:
+			return consumeProtobufString(fieldType, b, &reading.SensorId)
+		case 2:
+			return consumeProtobufString(fieldType, b, &reading.SensorType)
+		case 3:
+			return consumeProtobufString(fieldType, b, &reading.Quantity)
+		case 4:
+			return consumeProtobufString(fieldType, b, &reading.Timestamp)
+		case 5:
+			return consumeProtobufDouble(fieldType, b, &reading.Value)
+		case 6:
+			return consumeProtobufString(fieldType, b, &reading.Unit)
+		case 7:
+			return consumeProtobufString(fieldType, b, &reading.HardwareModel)
+		case 8:
+			return consumeProtobufMessage(fieldType, b, func(message []byte) error {
+				measurement, err := decodeProtobufMeasurement(message)
+				reading.Measurements = append(reading.Measurements, measurement)
+				return err
+			}, &nestedErr)
+		case 9:
+			return consumeProtobufVarint(fieldType, b, &reading.Sequence)
+		}
+		return 0, false
+	})
+	if err == nil {
+		err = nestedErr
+	}
+	return reading, err
+}
+
+func decodeProtobufBatch(b []byte) (Batch, error) {
+	batch := Batch{}
+	var nestedErr error
+	err := consumeProtobufFields(b, func(number protowire.Number, fieldType protowire.Type, b []byte) (int, bool) {
+		switch number {
+		case 1:
+			return consumeProtobufString(fieldType, b, &batch.HardwareModel)
+		case 2:
+			return consumeProtobufMessage(fieldType, b, func(message []byte) error {
+				reading, err := decodeProtobufReading(message)
+				batch.Readings = append(batch.Readings, reading)
+				return err
+			}, &nestedErr)
+		}
+		return 0, false
+	})
+	if err == nil {
+		err = nestedErr
+	}
+	return batch, err
+}
+
+// a SensorPayload with either a reading or a batch
+func decodeProtobuf(payload []byte) (Batch, bool, error) {
+	batch, isBatch, found := Batch{}, false, false
+	var nestedErr error
+	err := consumeProtobufFields(payload, func(number protowire.Number, fieldType protowire.Type, b []byte) (int, bool) {
+		switch number {
+		case 2:
+			return consumeProtobufMessage(fieldType, b, func(message []byte) error {
+				found, isBatch = true, false
+				reading, err := decodeProtobufReading(message)
+				batch = Batch{Readings: []Reading{reading}}
+				return err
+			}, &nestedErr)
+		case 3:
+			return consumeProtobufMessage(fieldType, b, func(message []byte) (err error) {
+				found, isBatch = true, true
+				batch, err = decodeProtobufBatch(message)
+				return err
+			}, &nestedErr)
+		}
+		return 0, false
+	})
+	if err == nil {
+		err = nestedErr
+	}
+	if err == nil && !found {
+		err = fmt.Errorf("the protobuf payload has neither a reading nor a batch")
+	}
+	return batch, isBatch, err
+}
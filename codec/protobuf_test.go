@@ -0,0 +1,207 @@
+package codec
+
+import (
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var protoMessagePattern = regexp.MustCompile(`(?s)message (\w+) \{(.*?)\n\}`)
+var protoFieldPattern = regexp.MustCompile(`(?m)^\s*(?:repeated |optional )?\w+ (\w+) = (\d+);`)
+
+// the field numbers of sensor.proto by message and field name, so the hand-written encoding is checked against it
+func readProtoFieldNumbers(t *testing.T) map[string]map[string]protowire.Number {
+	contents, err := ioutil.ReadFile("sensor.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]map[string]protowire.Number{}
+	for _, message := range protoMessagePattern.FindAllStringSubmatch(string(contents), -1) {
+		fields := map[string]protowire.Number{}
+		for _, field := range protoFieldPattern.FindAllStringSubmatch(message[2], -1) {
+			number, _ := strconv.Atoi(field[2])
+			fields[field[1]] = protowire.Number(number)
+		}
+		messages[message[1]] = fields
+	}
+	return messages
+}
+
+// the fields of an encoded message by name: strings and nested messages as string, doubles as float64, varints as uint64
+func readProtoFields(t *testing.T, names map[string]protowire.Number, b []byte) map[string][]interface{} {
+	byNumber := map[protowire.Number]string{}
+	for name, number := range names {
+		byNumber[number] = name
+	}
+	fields := map[string][]interface{}{}
+	for len(b) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		var value interface{}
+		switch fieldType {
+		case protowire.BytesType:
+			var bytes []byte
+			bytes, n = protowire.ConsumeBytes(b)
+			value = string(bytes)
+		case protowire.Fixed64Type:
+			var bits uint64
+			bits, n = protowire.ConsumeFixed64(b)
+			value = math.Float64frombits(bits)
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", fieldType, number)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		name, ok := byNumber[number]
+		if !ok {
+			t.Fatalf("field %d is not in sensor.proto", number)
+		}
+		fields[name] = append(fields[name], value)
+	}
+	return fields
+}
+
+func checkProtoFields(t *testing.T, message string, fields map[string][]interface{}, want map[string][]interface{}) {
+	for name, values := range want {
+		if !reflect.DeepEqual(fields[name], values) {
+			t.Errorf("%s.%s is %v, want %v", message, name, fields[name], values)
+		}
+	}
+	for name := range fields {
+		if _, ok := want[name]; !ok {
+			t.Errorf("%s.%s is set, but should not be", message, name)
+		}
+	}
+}
+
+func TestProtobufReadingFieldNumbers(t *testing.T) {
+	messages := readProtoFieldNumbers(t)
+	payload := readProtoFields(t, messages["SensorPayload"], encodeProtobufReading(testBatch().Readings[1]))
+	if len(payload["reading"]) != 1 || len(payload["batch"]) != 0 {
+		t.Fatalf("a reading is encoded as SensorPayload %v", payload)
+	}
+	reading := readProtoFields(t, messages["Reading"], []byte(payload["reading"][0].(string)))
+	measurements := reading["measurements"]
+	delete(reading, "measurements")
+	// zero values are left out as usual for proto3, here those of the multi-quantity reading
+	checkProtoFields(t, "Reading", reading, map[string][]interface{}{
+		"sensor_id":      {"sensor-1"},
+		"sensor_type":    {"AM2302"},
+		"timestamp":      {"2020-09-13T12:26:40Z"},
+		"hardware_model": {"raspberry-pi"},
+		"sequence":       {uint64(7)},
+	})
+	if len(measurements) != 2 {
+		t.Fatalf("Reading.measurements has %d entries, want 2", len(measurements))
+	}
+	checkProtoFields(t, "Measurement", readProtoFields(t, messages["Measurement"], []byte(measurements[1].(string))), map[string][]interface{}{
+		"quantity": {"humidity"},
+		"value":    {40.0},
+		"unit":     {"%RH"},
+	})
+}
+
+func TestProtobufBatchFieldNumbers(t *testing.T) {
+	messages := readProtoFieldNumbers(t)
+	payload := readProtoFields(t, messages["SensorPayload"], encodeProtobufBatch(testBatch()))
+	if len(payload["batch"]) != 1 || len(payload["reading"]) != 0 {
+		t.Fatalf("a batch is encoded as SensorPayload %v", payload)
+	}
+	batch := readProtoFields(t, messages["Batch"], []byte(payload["batch"][0].(string)))
+	if len(batch["readings"]) != 2 {
+		t.Fatalf("Batch.readings has %d entries, want 2", len(batch["readings"]))
+	}
+	delete(batch, "readings")
+	checkProtoFields(t, "Batch", batch, map[string][]interface{}{"hardware_model": {"raspberry-pi"}})
+}
+
+func TestProtobufValueFieldNumbers(t *testing.T) {
+	messages := readProtoFieldNumbers(t)
+	rawValue := 21.0
+	value := Value{
+		Timestamp: "2020-09-13T12:26:40Z",
+		Value:     21.5,
+		Unit:      "°C",
+		RawValue:  &rawValue,
+		Sequence:  42,
+		Provenance: &Provenance{
+			Version:       2,
+			SensorId:      "sensor-1",
+			SensorType:    "AM2302",
+			Quantity:      "temperature",
+			HardwareModel: "raspberry-pi",
+			ReceivedAt:    "2020-09-13T12:26:41Z",
+			Quality:       []string{"calibrated", "computed"},
+		},
+	}
+	checkProtoFields(t, "Value", readProtoFields(t, messages["Value"], encodeProtobufValue(value)), map[string][]interface{}{
+		"timestamp":      {"2020-09-13T12:26:40Z"},
+		"value":          {21.5},
+		"unit":           {"°C"},
+		"raw_value":      {21.0},
+		"sequence":       {uint64(42)},
+		"version":        {uint64(2)},
+		"sensor_id":      {"sensor-1"},
+		"sensor_type":    {"AM2302"},
+		"quantity":       {"temperature"},
+		"hardware_model": {"raspberry-pi"},
+		"received_at":    {"2020-09-13T12:26:41Z"},
+		"quality":        {"calibrated", "computed"},
+	})
+
+	// without provenance and sequence; a raw value of zero is still written, as it is optional
+	zero := 0.0
+	plain := Value{Timestamp: "2020-09-13T12:26:40Z", Value: 1, Unit: "°C", RawValue: &zero}
+	checkProtoFields(t, "Value", readProtoFields(t, messages["Value"], encodeProtobufValue(plain)), map[string][]interface{}{
+		"timestamp": {"2020-09-13T12:26:40Z"},
+		"value":     {1.0},
+		"unit":      {"°C"},
+		"raw_value": {0.0},
+	})
+
+	values := readProtoFields(t, messages["Values"], encodeProtobufValues([]Value{value, plain}))
+	if len(values["values"]) != 2 {
+		t.Errorf("Values.values has %d entries, want 2", len(values["values"]))
+	}
+}
+
+// decoders must skip fields they do not know, so the format can grow
+func TestProtobufSkipsUnknownFields(t *testing.T) {
+	reading := encodeProtobufReadingMessage(testReading())
+	reading = protowire.AppendTag(reading, 100, protowire.VarintType)
+	reading = protowire.AppendVarint(reading, 1)
+	reading = protowire.AppendTag(reading, 101, protowire.BytesType)
+	reading = protowire.AppendString(reading, "future")
+	payload := protowire.AppendTag(nil, 2, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, reading)
+
+	batch, isBatch, err := decodeProtobuf(payload)
+	if err != nil || isBatch || !reflect.DeepEqual(batch.Readings, []Reading{testReading()}) {
+		t.Errorf("decoding a reading with unknown fields gives %+v, %t, %v", batch, isBatch, err)
+	}
+}
+
+func TestProtobufRejectsInvalidPayloads(t *testing.T) {
+	valid := encodeProtobufReading(testReading())
+	for name, payload := range map[string][]byte{
+		"truncated":       valid[:len(valid)-3],
+		"without reading": protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1),
+		"wrong wire type": protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), 1),
+	} {
+		if _, _, err := decodeProtobuf(payload); err == nil {
+			t.Errorf("decoding a %s payload gives no error", name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"math"
+	"strings"
+	"time"
+)
+
+// IETF SenML (RFC 8428) records; string, boolean and data values are not supported
+type senmlRecord struct {
+	BaseName  string   `json:"bn,omitempty" cbor:"-2,keyasint,omitempty"`
+	BaseTime  float64  `json:"bt,omitempty" cbor:"-3,keyasint,omitempty"`
+	BaseUnit  string   `json:"bu,omitempty" cbor:"-4,keyasint,omitempty"`
+	BaseValue float64  `json:"bv,omitempty" cbor:"-5,keyasint,omitempty"`
+	Name      string   `json:"n,omitempty" cbor:"0,keyasint,omitempty"`
+	Unit      string   `json:"u,omitempty" cbor:"1,keyasint,omitempty"`
+	Value     *float64 `json:"v,omitempty" cbor:"2,keyasint,omitempty"`
+	Time      float64  `json:"t,omitempty" cbor:"6,keyasint,omitempty"`
+}
+
+// SenML times below 2^28 are relative to now
+const senmlRelativeTimeLimit = 1 << 28
+
+// SenML units that the units registry does not know under that name, and back
+var senmlUnits = map[string]string{"Cel": "°C", "m/s2": "m/s²"}
+
+// names are <sensor ID><separator><quantity>, with : or / as separator, e.g. urn:dev:mac:0024befffe804ff1:temperature
+const senmlNameSeparator = ":"
+
+func decodeSenmlJson(payload []byte) (Batch, error) {
+	records := []senmlRecord{}
+	if err := json.Unmarshal(payload, &records); err != nil {
+		return Batch{}, err
+	}
+	return senmlRecordsToBatch(records, time.Now())
+}
+
+func decodeSenmlCbor(payload []byte) (Batch, error) {
+	records := []senmlRecord{}
+	if err := cbor.Unmarshal(payload, &records); err != nil {
+		return Batch{}, err
+	}
+	return senmlRecordsToBatch(records, time.Now())
+}
+
+// base values apply to all following records until they are set again
+func senmlRecordsToBatch(records []senmlRecord, now time.Time) (Batch, error) {
+	batch := Batch{}
+	baseName, baseTime, baseUnit, baseValue := "", 0.0, "", 0.0
+	for i, record := range records {
+		if record.BaseName != "" {
+			baseName = record.BaseName
+		}
+		if record.BaseTime != 0 {
+			baseTime = record.BaseTime
+		}
+		if record.BaseUnit != "" {
+			baseUnit = record.BaseUnit
+		}
+		if record.BaseValue != 0 {
+			baseValue = record.BaseValue
+		}
+		if record.Value == nil {
+			return Batch{}, fmt.Errorf("SenML record %d has no numeric value", i)
+		}
+
+		name := baseName + record.Name
+		separator := strings.LastIndexAny(name, ":/")
+		if separator <= 0 || separator == len(name)-1 {
+			return Batch{}, fmt.Errorf("SenML record %d: name %s is not <sensor ID>:<quantity>", i, name)
+		}
+		unit := record.Unit
+		if unit == "" {
+			unit = baseUnit
+		}
+		if known, ok := senmlUnits[unit]; ok {
+			unit = known
+		}
+		seconds := baseTime + record.Time
+		// nanoseconds since 1970 do not fit a float64 exactly, so the fraction is converted on its own
+		whole := math.Floor(seconds)
+		offset := time.Duration(whole)*time.Second + time.Duration(math.Round((seconds-whole)*1e9))
+		measuredAt := time.Unix(0, 0).Add(offset)
+		if math.Abs(seconds) < senmlRelativeTimeLimit {
+			measuredAt = now.Add(offset)
+		}
+
+		batch.Readings = append(batch.Readings, Reading{
+			SensorId:  name[:separator],
+			Quantity:  name[separator+1:],
+			Timestamp: measuredAt.UTC().Format(time.RFC3339Nano),
+			Value:     baseValue + *record.Value,
+			Unit:      unit,
+		})
+	}
+	return batch, nil
+}
+
+func toSenmlRecord(name string, timestamp string, value float64, unit string) (senmlRecord, error) {
+	measuredAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return senmlRecord{}, err
+	}
+	for senmlUnit, knownUnit := range senmlUnits {
+		if unit == knownUnit {
+			unit = senmlUnit
+		}
+	}
+	return senmlRecord{
+		Name:  name,
+		Unit:  unit,
+		Value: &value,
+		Time:  float64(measuredAt.Unix()) + float64(measuredAt.Nanosecond())/1e9,
+	}, nil
+}
+
+func marshalSenml(format Format, records []senmlRecord) ([]byte, error) {
+	if format == FormatSenmlCbor {
+		return cbor.Marshal(records)
+	}
+	return json.Marshal(records)
+}
+
+// SenML has no sensor type or hardware model, so they are lost
+func encodeSenmlReadings(format Format, readings []Reading) ([]byte, error) {
+	records := []senmlRecord{}
+	for _, reading := range readings {
+		measurements := reading.Measurements
+		if len(measurements) == 0 {
+			measurements = []Measurement{{Quantity: reading.Quantity, Value: reading.Value, Unit: reading.Unit}}
+		}
+		for _, measurement := range measurements {
+			record, err := toSenmlRecord(reading.SensorId+senmlNameSeparator+measurement.Quantity, reading.Timestamp, measurement.Value, measurement.Unit)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+	return marshalSenml(format, records)
+}
+
+func encodeSenmlValues(format Format, name string, values []Value) ([]byte, error) {
+	records := []senmlRecord{}
+	for _, value := range values {
+		record, err := toSenmlRecord(name, value.Timestamp, value.Value, value.Unit)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return marshalSenml(format, records)
+}
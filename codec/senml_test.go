@@ -0,0 +1,120 @@
+package codec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSenmlBaseFields(t *testing.T) {
+	// base values apply until set again, names and values are added, times too
+	payload := `[
+		{"bn":"urn:dev:mac:0024befffe804ff1:","bt":1600000000,"bu":"Cel","n":"temperature","v":21.5,"t":1},
+		{"n":"humidity","u":"%RH","v":40},
+		{"bn":"station/","bv":10,"n":"temperature","v":1.5,"t":-1},
+		{"bt":1600000100,"n":"acceleration","u":"m/s2","v":0}
+	]`
+	format, batch, isBatch, err := Decode([]byte(payload))
+	if err != nil || format != FormatSenmlJson || !isBatch {
+		t.Fatalf("Decode gives %s, batch %t, %v", format, isBatch, err)
+	}
+	want := []Reading{
+		{SensorId: "urn:dev:mac:0024befffe804ff1", Quantity: "temperature", Timestamp: "2020-09-13T12:26:41Z", Value: 21.5, Unit: "°C"},
+		{SensorId: "urn:dev:mac:0024befffe804ff1", Quantity: "humidity", Timestamp: "2020-09-13T12:26:40Z", Value: 40, Unit: "%RH"},
+		{SensorId: "station", Quantity: "temperature", Timestamp: "2020-09-13T12:26:39Z", Value: 11.5, Unit: "°C"},
+		{SensorId: "station", Quantity: "acceleration", Timestamp: "2020-09-13T12:28:20Z", Value: 10, Unit: "m/s²"},
+	}
+	if !reflect.DeepEqual(batch.Readings, want) {
+		t.Errorf("the readings are\n%+v\nwant\n%+v", batch.Readings, want)
+	}
+}
+
+func TestSenmlRelativeTime(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	value := 1.0
+	batch, err := senmlRecordsToBatch([]senmlRecord{
+		{Name: "sensor-1:temperature", Value: &value, Time: -5},
+		{BaseTime: -60, Name: "sensor-1:temperature", Value: &value, Time: 0.5},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"2020-09-13T11:59:55Z", "2020-09-13T11:59:00.5Z"} {
+		if batch.Readings[i].Timestamp != want {
+			t.Errorf("reading %d has timestamp %s, want %s", i, batch.Readings[i].Timestamp, want)
+		}
+	}
+}
+
+func TestSenmlInvalidRecords(t *testing.T) {
+	for name, payload := range map[string]string{
+		"without value":       `[{"n":"sensor-1:temperature","t":1600000000}]`,
+		"without quantity":    `[{"n":"sensor-1","v":1}]`,
+		"with empty quantity": `[{"n":"sensor-1:","v":1}]`,
+		"without sensor ID":   `[{"n":":temperature","v":1}]`,
+		"without name":        `[{"v":1}]`,
+	} {
+		if _, _, _, err := Decode([]byte(payload)); err == nil {
+			t.Errorf("a record %s is accepted", name)
+		}
+	}
+}
+
+func TestSenmlRoundTrip(t *testing.T) {
+	reading := testReading()
+	multi := testBatch().Readings[1]
+	// SenML has no sensor type, hardware model or sequence, and one record per quantity
+	want := []Reading{
+		{SensorId: "sensor-1", Quantity: "temperature", Timestamp: "2020-09-13T12:26:40Z", Value: 21.5, Unit: "°C"},
+		{SensorId: "sensor-1", Quantity: "temperature", Timestamp: "2020-09-13T12:26:40Z", Value: 21.5, Unit: "°C"},
+		{SensorId: "sensor-1", Quantity: "humidity", Timestamp: "2020-09-13T12:26:40Z", Value: 40, Unit: "%RH"},
+	}
+	for _, format := range []Format{FormatSenmlJson, FormatSenmlCbor} {
+		payload, err := EncodeBatch(format, Batch{Readings: []Reading{reading, multi}})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		_, batch, _, err := Decode(payload)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(batch.Readings, want) {
+			t.Errorf("%s: the round trip gives\n%+v\nwant\n%+v", format, batch.Readings, want)
+		}
+	}
+}
+
+func TestSenmlValues(t *testing.T) {
+	values := []Value{
+		{Timestamp: "2020-09-13T12:26:40Z", Value: 21.5, Unit: "°C", Sequence: 1},
+		{Timestamp: "2020-09-13T12:26:41.25Z", Value: 9.81, Unit: "m/s²", Sequence: 2},
+	}
+	payload, err := EncodeValues(FormatSenmlJson, "sensor-1:temperature", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SenML units on the wire, and nothing SenML does not define
+	for _, want := range []string{`"u":"Cel"`, `"u":"m/s2"`, `"n":"sensor-1:temperature"`} {
+		if !strings.Contains(string(payload), want) {
+			t.Errorf("%s does not contain %s", payload, want)
+		}
+	}
+	if strings.Contains(string(payload), "Sequence") {
+		t.Errorf("%s has a sequence", payload)
+	}
+	_, batch, _, err := Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, value := range values {
+		reading := batch.Readings[i]
+		if reading.Timestamp != value.Timestamp || reading.Value != value.Value || reading.Unit != value.Unit {
+			t.Errorf("value %d decodes as %+v, want %+v", i, reading, value)
+		}
+	}
+
+	if _, err := EncodeValue(FormatSenmlCbor, "sensor-1:temperature", Value{Timestamp: "yesterday"}); err == nil {
+		t.Error("a value with an invalid timestamp is encoded")
+	}
+}
@@ -4,7 +4,19 @@
 set -e
 set -u
 
-echo "Configuring mosquitto to use the HTTP auth backend at ${MOSQUITTO_AUTH_HTTP_HOST}:${MOSQUITTO_AUTH_HTTP_PORT}"
+# set to true if the sensor manager serves its auth endpoints over TLS
+MOSQUITTO_AUTH_HTTP_WITH_TLS="${MOSQUITTO_AUTH_HTTP_WITH_TLS:-false}"
+# optional: a private CA that signed the sensor manager's certificate, added to the trust store the auth plugin uses;
+# the certificate must be issued for MOSQUITTO_AUTH_HTTP_HOST
+MOSQUITTO_AUTH_HTTP_CA_FILE="${MOSQUITTO_AUTH_HTTP_CA_FILE:-}"
+
+if [ -n "${MOSQUITTO_AUTH_HTTP_CA_FILE}" ]; then
+  echo "Trusting ${MOSQUITTO_AUTH_HTTP_CA_FILE} for the HTTP auth backend"
+  cp "${MOSQUITTO_AUTH_HTTP_CA_FILE}" /usr/local/share/ca-certificates/sensor-manager-auth-ca.crt
+  update-ca-certificates
+fi
+
+echo "Configuring mosquitto to use the HTTP auth backend at ${MOSQUITTO_AUTH_HTTP_HOST}:${MOSQUITTO_AUTH_HTTP_PORT} (TLS: ${MOSQUITTO_AUTH_HTTP_WITH_TLS})"
 cat >/etc/mosquitto/mosquitto.conf.d/mosquitto-auth.conf <<EOF
 # the auth_plugin option must be specified here lest mosquitto complains
 # so just specify everything here
@@ -16,7 +28,7 @@ auth_opt_http_hostname      ${MOSQUITTO_AUTH_HTTP_HOST}
 auth_opt_http_getuser_uri   /auth
 auth_opt_http_superuser_uri /superuser
 auth_opt_http_aclcheck_uri  /acl
-auth_opt_http_with_tls      false
+auth_opt_http_with_tls      ${MOSQUITTO_AUTH_HTTP_WITH_TLS}
 auth_opt_http_retry_count   2
 EOF
 
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"mf2c-sensor-manager/codec"
 	sensormanager "mf2c-sensor-manager/sensor-manager"
 	"os"
 	"strconv"
@@ -41,6 +42,18 @@ func main() {
 		panic(fmt.Errorf("sensor manager topic not specified"))
 	}
 
+	// optional, only used for the sensor registry
+	sensorHardwareModel := os.Getenv("SENSOR_HARDWARE_MODEL")
+
+	// optional, see the codec package
+	payloadFormat := codec.FormatJson
+	if formatName, present := os.LookupEnv("SENSOR_PAYLOAD_FORMAT"); present {
+		payloadFormat, err = codec.ParseFormat(formatName)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	sensorManagerConnectionInfoString := os.Getenv("SENSOR_CONNECTION_INFO")
 	var sensorManagerConnectionInfo map[string]interface{}
 	err = json.Unmarshal([]byte(sensorManagerConnectionInfoString), &sensorManagerConnectionInfo)
@@ -56,20 +69,22 @@ func main() {
 	log.Print("WARNING: a successful connection does not mean writes will succeed - the MQTT server silently drops unauthorised writes!")
 
 	for i := 1; true; i++ {
-		reading := sensormanager.IncomingSensorMessage{
-			SensorId:   "example-driver",
-			SensorType: "example-driver",
-			Quantity:   "example-count",
-			Timestamp:  time.Now().Format(time.RFC3339Nano),
-			Value:      float64(i),
-			Unit:       "times",
+		reading := codec.Reading{
+			SensorId:      "example-driver",
+			SensorType:    "example-driver",
+			Quantity:      "count",
+			Timestamp:     time.Now().Format(time.RFC3339Nano),
+			Value:         float64(i),
+			Unit:          "times",
+			HardwareModel: sensorHardwareModel,
+			Sequence:      uint64(i),
 		}
-		readingJson, err := json.Marshal(reading)
+		encodedReading, err := codec.EncodeReading(payloadFormat, reading)
 		if err != nil {
 			panic(err)
 		}
 
-		sendtoken := mqttClient.Publish(sensorManagerTopic, 0, false, readingJson)
+		sendtoken := mqttClient.Publish(sensorManagerTopic, 0, false, encodedReading)
 		if sendtoken.Wait() && sendtoken.Error() != nil {
 			log.Print(sendtoken.Error())
 		} else {
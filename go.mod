@@ -4,6 +4,9 @@ go 1.12
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.1.1
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/spf13/pflag v1.0.3
-	golang.org/x/net v0.0.0-20190228165749-92fc7df08ae7 // indirect
+	golang.org/x/net v0.0.0-20190228165749-92fc7df08ae7
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.4.0
 )
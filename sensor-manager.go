@@ -6,88 +6,79 @@ import (
 	"hash/crc64"
 	"log"
 	"math/rand"
+	"mf2c-sensor-manager/codec"
 	sensormanager "mf2c-sensor-manager/sensor-manager"
 	"os"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-func runSensorSimulator(mqttHost string, mqttPort uint16, sensorDriverPassword string) {
+func runSensorSimulator(config sensormanager.Config) {
 	log.Println("Starting in sensor simulation mode.")
-	mqttClient := sensormanager.ConnectMqttClient(fmt.Sprintf("ws://%s:%d", mqttHost, mqttPort), "sensor-simulator", sensormanager.SensorDriverUsername, sensorDriverPassword)
-	sensormanager.PublishMessagesIndefinitely(mqttClient, sensormanager.TopicSensorReceive, 1*time.Second)
+	mqttClient := sensormanager.ConnectMqttClient(fmt.Sprintf("ws://%s:%d", config.Mqtt.Host, config.Mqtt.Port), "sensor-simulator", sensormanager.SensorDriverUsername, config.Secrets.SensorDriverAccessToken)
+	// validated beforehand
+	format, _ := codec.ParseFormat(config.SimulatorFormat)
+	sensormanager.PublishMessagesIndefinitely(mqttClient, sensormanager.TopicSensorReceive, 1*time.Second, format)
 }
 
-func runProduction(mqttHost string, mqttPort uint16, cimiTraefikHost string, cimiTraefikPort uint16, lifecycleHost string, lifecyclePort uint16,
-	authDatabase sensormanager.AuthDatabase, httpServerPort uint16, sensorCheckIntervalSeconds uint, sensorContainerMapFilename string, sensorDriverDockerNetworkName string, mqttPathSuffix string) {
+func runProduction(config sensormanager.Config, authDatabase sensormanager.AuthDatabase, sensorRegistry *sensormanager.SensorRegistry, runtimeSettings *sensormanager.RuntimeSettings) {
 	log.Println("Starting in production mode.")
 	// the server needs to start beforehand, as message transformations connect to MQTT and thus require auth
 	wg := sync.WaitGroup{}
 	wg.Add(3)
-	go sensormanager.StartBlockingHttpServer(&wg, &authDatabase, httpServerPort)
-	mqttClient := sensormanager.ConnectMqttClient(fmt.Sprintf("ws://%s:%d", mqttHost, mqttPort), "sensor-manager", sensormanager.SuperuserUsername, authDatabase.AdministratorAccessToken)
-	go sensormanager.StartMessageTransformations(&wg, &authDatabase, mqttClient)
-	go sensormanager.StartContainerManager(&wg, cimiTraefikHost, cimiTraefikPort, lifecycleHost, lifecyclePort, mqttHost, mqttPort, &authDatabase, sensorCheckIntervalSeconds, sensorContainerMapFilename, sensorDriverDockerNetworkName, mqttPathSuffix)
+	broadcaster := sensormanager.NewValueBroadcaster()
+	latestValues := sensormanager.NewLatestValueCache()
+	metrics := sensormanager.NewMetrics()
+	deadLetters := sensormanager.NewDeadLetterLog(config.Validation.RecentRejectionsCount)
+	alerts := sensormanager.LoadOrCreateAlertEngine(config.Alerts.RulesFile, config.Alerts.Rules, metrics)
+	history := sensormanager.NewHistoryStore(config.HistorySettings())
+	virtualSensors := sensormanager.NewVirtualSensors(config.VirtualSensors, metrics)
+	topicSequences := sensormanager.LoadOrCreateTopicSequences(config.SequencesFile)
+	driverSequences := sensormanager.NewDriverSequences(metrics)
+	go topicSequences.PersistOnShutdown()
+	go history.PruneHistoryPeriodically(&authDatabase)
+	go authDatabase.RemoveIdleVariantsPeriodically()
+	go sensorRegistry.PersistPeriodically()
+	go sensormanager.StartBlockingHttpServer(&wg, &authDatabase, broadcaster, latestValues, sensorRegistry, metrics, deadLetters, alerts, history, driverSequences, uint16(config.Http.Port), config.HttpTlsParameters(), config.HttpAllowedOrigins())
+	mqttClient := sensormanager.ConnectMqttClient(fmt.Sprintf("ws://%s:%d", config.Mqtt.Host, config.Mqtt.Port), "sensor-manager", sensormanager.SuperuserUsername, authDatabase.AdministratorAccessToken)
+	go sensorRegistry.WatchLiveness(mqttClient, &authDatabase)
+	go history.RunReplays(mqttClient, &authDatabase)
+	go sensormanager.StartMessageTransformations(&wg, &authDatabase, broadcaster, latestValues, sensorRegistry, metrics, deadLetters, alerts, history, virtualSensors, topicSequences, driverSequences, config.ValidationLimits(), config.PublishSettings(), config.OrderingSettings(), config.PipelineSettings(), mqttClient)
+	go sensormanager.StartContainerManager(&wg, config.Cimi.Host, uint16(config.Cimi.Port), config.Lifecycle.Host, uint16(config.Lifecycle.Port),
+		config.Mqtt.Host, uint16(config.Mqtt.Port), &authDatabase, runtimeSettings, config.SensorDriverDockerNetworkName, config.Mqtt.PathSuffix)
 	wg.Wait()
 }
 
-func getEnvMandatoryString(envName string) string {
-	value, exists := os.LookupEnv(envName)
-	if !exists {
-		panic(fmt.Errorf("environment variable %s is mandatory", envName))
-	} else {
-		log.Printf("Read env var %s as %s.", envName, value)
-		return value
-	}
-}
-
-func getEnvMandatoryInt(envName string) int {
-	stringVal := getEnvMandatoryString(envName)
-	intVal, err := strconv.Atoi(stringVal)
-	if err != nil {
-		panic(fmt.Errorf("could not parse integer from %s for env var %s", stringVal, envName))
-	}
-	return intVal
-}
-
 func main() {
 	simulateSensor := flag.Bool("simulate-sensor", false, "Test mode: sensor simulation.")
+	configFilename := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML config file; env vars and flags override its values (env CONFIG_FILE)")
+	sensormanager.RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
 
-	mqttHost := getEnvMandatoryString("MQTT_HOST")
-	mqttPort := getEnvMandatoryInt("MQTT_PORT")
-	sensorDriverAccessToken := getEnvMandatoryString("SENSOR_DRIVER_ACCESS_TOKEN")
+	// everything is checked before giving up, so all problems can be fixed in one go
+	config, loadErr := sensormanager.LoadConfig(*configFilename, flag.CommandLine)
+	validateErr := config.Validate(!*simulateSensor)
+	if loadErr != nil || validateErr != nil {
+		problems := []string{}
+		for _, err := range []error{loadErr, validateErr} {
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		log.Fatal(strings.Join(problems, "\n"))
+	}
+	config.LogEffectiveValues()
+	runtimeSettings := sensormanager.NewRuntimeSettings(config)
 
 	if *simulateSensor {
-		runSensorSimulator(mqttHost, uint16(mqttPort), sensorDriverAccessToken)
+		runSensorSimulator(config)
 	} else {
-		httpServerPort := getEnvMandatoryInt("HTTP_PORT")
-		authDatabaseFilename := getEnvMandatoryString("AUTH_DB_FILE")
-		administratorAccessToken := getEnvMandatoryString("ADMINISTRATOR_ACCESS_TOKEN")
-		applicationSecret := getEnvMandatoryString("APPLICATION_SECRET")
-		cimiHost := getEnvMandatoryString("CIMI_HOST")
-		cimiPort := getEnvMandatoryInt("CIMI_PORT")
-		lifecycleHost := getEnvMandatoryString("LIFECYCLE_HOST")
-		lifecyclePort := getEnvMandatoryInt("LIFECYCLE_PORT")
-		sensorsCheckIntervalSeconds := getEnvMandatoryInt("SENSORS_CHECK_INTERVAL_SECONDS")
-		sensorContainerMapFilename := getEnvMandatoryString("SENSOR_CONTAINER_MAP_FILE")
-		sensorDriverDockerNetworkName := getEnvMandatoryString("SENSOR_DRIVER_DOCKER_NETWORK_NAME")
-		mqttPathSuffix := getEnvMandatoryString("MQTT_PATH_SUFFIX")
-
-		rand.Seed(int64(crc64.Checksum([]byte(applicationSecret), crc64.MakeTable(crc64.ECMA))))
-		authDatabase := sensormanager.LoadOrCreateAuthDatabase(authDatabaseFilename, administratorAccessToken, sensorDriverAccessToken)
-
-		runProduction(
-			mqttHost, uint16(mqttPort),
-			cimiHost, uint16(cimiPort),
-			lifecycleHost, uint16(lifecyclePort),
-			authDatabase,
-			uint16(httpServerPort),
-			uint(sensorsCheckIntervalSeconds),
-			sensorContainerMapFilename,
-			sensorDriverDockerNetworkName,
-			mqttPathSuffix,
-		)
+		go sensormanager.ReloadConfigOnSighup(*configFilename, flag.CommandLine, config, runtimeSettings)
+		rand.Seed(int64(crc64.Checksum([]byte(config.Secrets.ApplicationSecret), crc64.MakeTable(crc64.ECMA))))
+		authDatabase := sensormanager.LoadOrCreateAuthDatabase(config.AuthDbFile, config.Secrets.AdministratorAccessToken, config.Secrets.SensorDriverAccessToken, config.TopicLayout())
+		authDatabase.ReportTopicCollisions()
+		sensorRegistry := sensormanager.LoadOrCreateSensorRegistry(config.SensorRegistryFile, time.Duration(config.SensorAliveTimeoutSeconds)*time.Second)
+		runProduction(config, authDatabase, sensorRegistry, runtimeSettings)
 	}
 }
@@ -0,0 +1,186 @@
+package sensormanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// windows are closed by the first reading of a later window, or this long after their end if the sensor is silent;
+// readings for a window that has already been published are dropped
+const AggregateFlushDelay = 5 * time.Second
+
+// what subscribers of <topic>/agg/<window> get once per window, with the window being [Start, End)
+type AggregateClientMessage struct {
+	Start string
+	End   string
+	Count int
+	Mean  float64
+	Min   float64
+	Max   float64
+	// the value with the latest timestamp
+	Last float64
+	Unit string
+}
+
+// the labels are used as topic level, e.g. 1m,15m,1h; an empty list disables aggregates
+func parseAggregateWindows(labels string) (map[string]time.Duration, error) {
+	windows := map[string]time.Duration{}
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		window, err := time.ParseDuration(label)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate window %s: %s", label, err)
+		}
+		if window < time.Second {
+			return nil, fmt.Errorf("aggregate window %s must be at least one second", label)
+		}
+		windows[label] = window
+	}
+	return windows, nil
+}
+
+type aggregateWindow struct {
+	topic  SensorTopic
+	suffix string
+	policy PublishPolicy
+	length time.Duration
+	// zero while no window is open
+	start    time.Time
+	count    int
+	sum      float64
+	min      float64
+	max      float64
+	last     float64
+	lastTime time.Time
+	unit     string
+	// the end of the last published window
+	publishedUntil time.Time
+}
+
+func (receiver *aggregateWindow) add(measuredAt time.Time, message OutgoingClientMessage) {
+	if receiver.count == 0 || message.Value < receiver.min {
+		receiver.min = message.Value
+	}
+	if receiver.count == 0 || message.Value > receiver.max {
+		receiver.max = message.Value
+	}
+	if receiver.count == 0 || !measuredAt.Before(receiver.lastTime) {
+		receiver.last, receiver.lastTime = message.Value, measuredAt
+	}
+	receiver.count++
+	receiver.sum += message.Value
+	receiver.unit = message.Unit
+}
+
+func (receiver *aggregateWindow) close() AggregateClientMessage {
+	end := receiver.start.Add(receiver.length)
+	message := AggregateClientMessage{
+		Start: receiver.start.UTC().Format(time.RFC3339),
+		End:   end.UTC().Format(time.RFC3339),
+		Count: receiver.count,
+		Mean:  receiver.sum / float64(receiver.count),
+		Min:   receiver.min,
+		Max:   receiver.max,
+		Last:  receiver.last,
+		Unit:  receiver.unit,
+	}
+	*receiver = aggregateWindow{topic: receiver.topic, suffix: receiver.suffix, policy: receiver.policy, length: receiver.length, publishedUntil: end}
+	return message
+}
+
+// time.Truncate aligns to the zero time, which differs for windows that do not divide a day, e.g. 7m or 90m
+func alignToEpoch(measuredAt time.Time, length time.Duration) time.Time {
+	epoch := time.Unix(0, 0)
+	sinceEpoch := measuredAt.Sub(epoch)
+	start := epoch.Add(sinceEpoch / length * length)
+	// before the epoch, division rounds toward zero
+	if start.After(measuredAt) {
+		start = start.Add(-length)
+	}
+	return start
+}
+
+// tumbling windows per sensor, quantity and aggregate variant, aligned to the Unix epoch and by reading timestamp
+type outgoingAggregates struct {
+	lock    sync.Mutex
+	windows map[string]*aggregateWindow
+	metrics *Metrics
+}
+
+func newOutgoingAggregates(metrics *Metrics) *outgoingAggregates {
+	metrics.describe("sensor_manager_late_aggregate_readings_total", "Readings left out of aggregates, as their window had already been published.")
+	return &outgoingAggregates{windows: map[string]*aggregateWindow{}, metrics: metrics}
+}
+
+// the message is already converted to the variant's unit
+func (receiver *outgoingAggregates) add(publisher *Publisher, topic SensorTopic, suffix string, length time.Duration, policy PublishPolicy, message OutgoingClientMessage) {
+	measuredAt, err := time.Parse(time.RFC3339Nano, message.Timestamp)
+	if err != nil {
+		log.Printf("Skipping a reading for %s/%s: %s", topic.Name, suffix, err)
+		return
+	}
+	start := alignToEpoch(measuredAt, length)
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	key := buildSensorTopicKey(topic.SensorId, topic.Quantity) + "/" + suffix
+	window, ok := receiver.windows[key]
+	if !ok {
+		window = &aggregateWindow{suffix: suffix, length: length}
+		receiver.windows[key] = window
+	}
+	// renames and policy changes apply from the next publish on
+	window.topic, window.policy = topic, policy
+	if start.Before(window.publishedUntil) || (window.count > 0 && start.Before(window.start)) {
+		logDebugf("Reading for %s/%s at %s is too late for its aggregate window.", topic.Name, suffix, message.Timestamp)
+		receiver.metrics.incrementCounter("sensor_manager_late_aggregate_readings_total")
+		return
+	}
+	if window.count > 0 && start.After(window.start) {
+		publishAggregate(publisher, window.topic, window.suffix, window.policy, window.close())
+	}
+	window.start = start
+	window.add(measuredAt, message)
+}
+
+func (receiver *outgoingAggregates) flushDue(publisher *Publisher, now time.Time) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	keys := []string{}
+	for key := range receiver.windows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		window := receiver.windows[key]
+		if window.count > 0 && !now.Before(window.start.Add(window.length).Add(AggregateFlushDelay)) {
+			publishAggregate(publisher, window.topic, window.suffix, window.policy, window.close())
+		}
+	}
+}
+
+func (receiver *outgoingAggregates) flushPeriodically(publisher *Publisher) {
+	for now := range time.Tick(1 * time.Second) {
+		receiver.flushDue(publisher, now)
+	}
+}
+
+// aggregates are not streamed over HTTP, streams get every value anyway
+func publishAggregate(publisher *Publisher, topic SensorTopic, suffix string, policy PublishPolicy, message AggregateClientMessage) {
+	marshaled, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, name := range topic.activeNames(time.Now()) {
+		publisher.publish(name+"/"+suffix, policy, marshaled)
+	}
+}
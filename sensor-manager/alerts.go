@@ -0,0 +1,575 @@
+package sensormanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alert events go here, only the superuser may read it
+const TopicAlerts = "/sensor-manager/alerts"
+
+// how often stale rules are checked, and how long a webhook may take
+const AlertStaleCheckInterval = 5 * time.Second
+const AlertWebhookTimeout = 10 * time.Second
+
+type AlertCondition string
+
+const (
+	AlertConditionAbove AlertCondition = "above"
+	AlertConditionBelow AlertCondition = "below"
+	// the change per second between consecutive readings
+	AlertConditionRateAbove AlertCondition = "rate-above"
+	AlertConditionRateBelow AlertCondition = "rate-below"
+	// no reading for TimeoutSeconds; only sensors that sent since the start are watched
+	AlertConditionStale AlertCondition = "stale"
+)
+
+type AlertState string
+
+const (
+	AlertStateFiring   AlertState = "firing"
+	AlertStateResolved AlertState = "resolved"
+)
+
+// where a rule comes from; rules from the config file cannot be changed through the admin API
+const AlertRuleSourceConfig = "config"
+const AlertRuleSourceApi = "api"
+
+var alertRuleIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// evaluated per sensor and quantity, each of them fires and resolves on its own
+type AlertRule struct {
+	Id string `json:"id" yaml:"id"`
+	// empty matches every sensor or quantity
+	SensorId  string         `json:"sensorId,omitempty" yaml:"sensorId"`
+	Quantity  string         `json:"quantity,omitempty" yaml:"quantity"`
+	Condition AlertCondition `json:"condition" yaml:"condition"`
+	// in the canonical unit of the quantity, per second for rates
+	Threshold float64 `json:"threshold" yaml:"threshold"`
+	// a firing alert only resolves once the value is this far back on the other side of the threshold
+	Hysteresis float64 `json:"hysteresis,omitempty" yaml:"hysteresis"`
+	// for stale rules
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty" yaml:"timeoutSeconds"`
+	// optional: alert events are POSTed here as well
+	Webhook string `json:"webhook,omitempty" yaml:"webhook"`
+}
+
+// what is published on the alerts topic and sent to webhooks
+type AlertEvent struct {
+	RuleId    string         `json:"ruleId"`
+	State     AlertState     `json:"state"`
+	SensorId  string         `json:"sensorId"`
+	Quantity  string         `json:"quantity"`
+	Topic     string         `json:"topic"`
+	Condition AlertCondition `json:"condition"`
+	Threshold float64        `json:"threshold"`
+	// the value or rate of the reading that changed the state, not set for stale rules
+	Value *float64 `json:"value,omitempty"`
+	// of that reading, or when the sensor was found stale
+	Timestamp string `json:"timestamp"`
+}
+
+type AlertRuleResponse struct {
+	AlertRule
+	Source string `json:"source"`
+	// sorted by sensor ID and quantity
+	Firing []FiringAlert `json:"firing"`
+}
+
+type FiringAlert struct {
+	SensorId string    `json:"sensorId"`
+	Quantity string    `json:"quantity"`
+	Since    time.Time `json:"since"`
+}
+
+// the quantity is normalized, so it can be compared with that of readings
+func (receiver AlertRule) normalized() (AlertRule, error) {
+	if !alertRuleIdPattern.MatchString(receiver.Id) {
+		return receiver, fmt.Errorf("alert rule ID '%s' must consist of letters, digits, '.', '_' and '-'", receiver.Id)
+	}
+	if receiver.Quantity != "" {
+		quantity, ok := lookupQuantity(receiver.Quantity)
+		if !ok {
+			return receiver, fmt.Errorf("alert rule %s: unknown quantity %s", receiver.Id, receiver.Quantity)
+		}
+		receiver.Quantity = quantity.Name
+	}
+	switch receiver.Condition {
+	case AlertConditionAbove, AlertConditionBelow, AlertConditionRateAbove, AlertConditionRateBelow:
+	case AlertConditionStale:
+		if receiver.TimeoutSeconds <= 0 {
+			return receiver, fmt.Errorf("alert rule %s: a stale rule needs a positive timeout", receiver.Id)
+		}
+	default:
+		return receiver, fmt.Errorf("alert rule %s: unknown condition '%s', must be one of %s, %s, %s, %s or %s", receiver.Id, receiver.Condition,
+			AlertConditionAbove, AlertConditionBelow, AlertConditionRateAbove, AlertConditionRateBelow, AlertConditionStale)
+	}
+	if receiver.Hysteresis < 0 {
+		return receiver, fmt.Errorf("alert rule %s: hysteresis must not be negative", receiver.Id)
+	}
+	if receiver.Webhook != "" {
+		webhook, err := url.Parse(receiver.Webhook)
+		if err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") {
+			return receiver, fmt.Errorf("alert rule %s: webhook '%s' must be an http or https URL", receiver.Id, receiver.Webhook)
+		}
+	}
+	return receiver, nil
+}
+
+// whether a threshold rule fires given its current state; hysteresis only delays resolving
+func (receiver AlertRule) isFiring(firing bool, value float64) bool {
+	margin := 0.0
+	if firing {
+		margin = receiver.Hysteresis
+	}
+	if receiver.Condition == AlertConditionAbove || receiver.Condition == AlertConditionRateAbove {
+		return value > receiver.Threshold-margin
+	}
+	return value < receiver.Threshold+margin
+}
+
+type alertStatus struct {
+	sensorId string
+	quantity string
+	topic    string
+	firing   bool
+	since    time.Time
+	// of the latest reading, for rates
+	lastValue float64
+	lastTime  time.Time
+	// when the latest reading arrived, for stale rules
+	lastSeen time.Time
+}
+
+// evaluates rules over the readings flowing through; states are kept in memory only
+type AlertEngine struct {
+	Filename string
+	lock     sync.Mutex
+	// by ID
+	configRules map[string]AlertRule
+	apiRules    map[string]AlertRule
+	// by rule ID, then by sensor topic key
+	statuses map[string]map[string]*alertStatus
+	// by sensor ID, then quantity, with "" for rules that match any; see indexRulesLocked
+	index      map[string]map[string][]AlertRule
+	metrics    *Metrics
+	httpClient *http.Client
+}
+
+// rules added through the admin API are kept in the file; config rules win over them when IDs clash
+func LoadOrCreateAlertEngine(filename string, configRules []AlertRule, metrics *Metrics) *AlertEngine {
+	metrics.describe("sensor_manager_alerts_total", "Alert events, per rule and state.")
+	metrics.describe("sensor_manager_failed_webhooks_total", "Alert events that could not be sent to the rule's webhook.")
+	engine := &AlertEngine{
+		Filename:    filename,
+		configRules: map[string]AlertRule{},
+		apiRules:    map[string]AlertRule{},
+		statuses:    map[string]map[string]*alertStatus{},
+		metrics:     metrics,
+		httpClient:  &http.Client{Timeout: AlertWebhookTimeout},
+	}
+	for _, rule := range configRules {
+		// validated beforehand
+		normalized, _ := rule.normalized()
+		engine.configRules[rule.Id] = normalized
+	}
+	engine.indexRulesLocked()
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("Reading alert rules file %s failed, creating anew.", filename)
+		err = os.MkdirAll(path.Dir(filename), 0776)
+		if err != nil {
+			log.Println(fmt.Errorf("could not create alert rules parent directories, panic"))
+			panic(err)
+		}
+		engine.writeToFile()
+		return engine
+	}
+	apiRules := []AlertRule{}
+	if err := json.Unmarshal(contents, &apiRules); err != nil {
+		log.Println(fmt.Errorf("failed to unmarshal alert rules, panic"))
+		panic(err)
+	}
+	for _, rule := range apiRules {
+		if _, ok := engine.configRules[rule.Id]; ok {
+			log.Printf("Ignoring alert rule %s from %s, the config file defines a rule with that ID.", rule.Id, filename)
+			continue
+		}
+		engine.apiRules[rule.Id] = rule
+	}
+	engine.indexRulesLocked()
+	log.Printf("Loaded %d alert rules from the config file and %d from %s.", len(engine.configRules), len(engine.apiRules), filename)
+	return engine
+}
+
+// must be called with the lock held
+func (receiver *AlertEngine) writeToFile() {
+	rules := []AlertRule{}
+	for _, rule := range receiver.apiRules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Id < rules[j].Id
+	})
+	serialized, err := json.Marshal(rules)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(receiver.Filename, serialized, 0660)
+	if err != nil {
+		log.Println(fmt.Errorf("error writing alert rules file"))
+		log.Println(err)
+	}
+}
+
+// must be called with the lock held; sorted by ID
+func (receiver *AlertEngine) rulesLocked() []AlertRule {
+	rules := []AlertRule{}
+	for _, rule := range receiver.configRules {
+		rules = append(rules, rule)
+	}
+	for _, rule := range receiver.apiRules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Id < rules[j].Id
+	})
+	return rules
+}
+
+// must be called with the lock held, whenever rules change
+func (receiver *AlertEngine) indexRulesLocked() {
+	receiver.index = map[string]map[string][]AlertRule{}
+	for _, rule := range receiver.rulesLocked() {
+		byQuantity, ok := receiver.index[rule.SensorId]
+		if !ok {
+			byQuantity = map[string][]AlertRule{}
+			receiver.index[rule.SensorId] = byQuantity
+		}
+		byQuantity[rule.Quantity] = append(byQuantity[rule.Quantity], rule)
+	}
+}
+
+// the reading is normalized, as are the quantities of rules; must be called with the lock held
+func (receiver *AlertEngine) matchingRulesLocked(reading IncomingSensorMessage) []AlertRule {
+	rules := []AlertRule{}
+	for _, sensorId := range []string{reading.SensorId, ""} {
+		for _, quantity := range []string{reading.Quantity, ""} {
+			rules = append(rules, receiver.index[sensorId][quantity]...)
+		}
+	}
+	return rules
+}
+
+func (receiver *AlertEngine) statusFor(ruleId string, reading IncomingSensorMessage) *alertStatus {
+	statuses, ok := receiver.statuses[ruleId]
+	if !ok {
+		statuses = map[string]*alertStatus{}
+		receiver.statuses[ruleId] = statuses
+	}
+	key := buildSensorTopicKey(reading.SensorId, reading.Quantity)
+	status, ok := statuses[key]
+	if !ok {
+		status = &alertStatus{sensorId: reading.SensorId, quantity: reading.Quantity}
+		statuses[key] = status
+	}
+	return status
+}
+
+func newAlertEvent(rule AlertRule, status *alertStatus, value *float64, timestamp time.Time) AlertEvent {
+	state := AlertStateResolved
+	if status.firing {
+		state = AlertStateFiring
+	}
+	return AlertEvent{
+		RuleId:    rule.Id,
+		State:     state,
+		SensorId:  status.sensorId,
+		Quantity:  status.quantity,
+		Topic:     status.topic,
+		Condition: rule.Condition,
+		Threshold: rule.Threshold,
+		Value:     value,
+		Timestamp: timestamp.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// the reading is normalized; called for every reading of the incoming messages
+func (receiver *AlertEngine) evaluate(publisher *Publisher, reading IncomingSensorMessage, topicName string, now time.Time) {
+	measuredAt, err := time.Parse(time.RFC3339Nano, reading.Timestamp)
+	if err != nil {
+		return
+	}
+	events := []AlertEvent{}
+	webhooks := []string{}
+	receiver.lock.Lock()
+	for _, rule := range receiver.matchingRulesLocked(reading) {
+		status := receiver.statusFor(rule.Id, reading)
+		status.topic = topicName
+		wasFiring := status.firing
+		var value *float64
+		switch rule.Condition {
+		case AlertConditionStale:
+			status.firing = false
+		case AlertConditionAbove, AlertConditionBelow:
+			status.firing = rule.isFiring(status.firing, reading.Value)
+			value = &reading.Value
+		case AlertConditionRateAbove, AlertConditionRateBelow:
+			// out of order readings and the first one have no rate
+			if !status.lastTime.IsZero() && measuredAt.After(status.lastTime) {
+				rate := (reading.Value - status.lastValue) / measuredAt.Sub(status.lastTime).Seconds()
+				status.firing = rule.isFiring(status.firing, rate)
+				value = &rate
+			}
+		}
+		if status.lastTime.IsZero() || measuredAt.After(status.lastTime) {
+			status.lastValue, status.lastTime = reading.Value, measuredAt
+		}
+		status.lastSeen = now
+		if status.firing != wasFiring {
+			status.since = now
+			events = append(events, newAlertEvent(rule, status, value, measuredAt))
+			webhooks = append(webhooks, rule.Webhook)
+		}
+	}
+	receiver.lock.Unlock()
+	receiver.emit(publisher, events, webhooks)
+}
+
+func (receiver *AlertEngine) checkStale(publisher *Publisher, now time.Time) {
+	events := []AlertEvent{}
+	webhooks := []string{}
+	receiver.lock.Lock()
+	for _, rule := range receiver.rulesLocked() {
+		if rule.Condition != AlertConditionStale {
+			continue
+		}
+		keys := []string{}
+		for key := range receiver.statuses[rule.Id] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			status := receiver.statuses[rule.Id][key]
+			if status.firing || now.Sub(status.lastSeen) <= time.Duration(rule.TimeoutSeconds)*time.Second {
+				continue
+			}
+			status.firing = true
+			status.since = now
+			events = append(events, newAlertEvent(rule, status, nil, now))
+			webhooks = append(webhooks, rule.Webhook)
+		}
+	}
+	receiver.lock.Unlock()
+	receiver.emit(publisher, events, webhooks)
+}
+
+func (receiver *AlertEngine) checkStalePeriodically(publisher *Publisher) {
+	for now := range time.Tick(AlertStaleCheckInterval) {
+		receiver.checkStale(publisher, now)
+	}
+}
+
+// does not wait for the publish or the webhooks, as this runs in the workers processing incoming messages
+func (receiver *AlertEngine) emit(publisher *Publisher, events []AlertEvent, webhooks []string) {
+	for i, event := range events {
+		log.Printf("Alert %s %s for sensor %s, quantity %s.", event.RuleId, event.State, event.SensorId, event.Quantity)
+		receiver.metrics.incrementCounter("sensor_manager_alerts_total", "rule", event.RuleId, "state", string(event.State))
+		marshaled, err := json.Marshal(event)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		publisher.publish(TopicAlerts, PublishPolicy{Qos: 1}, marshaled)
+		if webhooks[i] != "" {
+			go receiver.postWebhook(webhooks[i], event.RuleId, marshaled)
+		}
+	}
+}
+
+func (receiver *AlertEngine) postWebhook(webhook string, ruleId string, payload []byte) {
+	response, err := receiver.httpClient.Post(webhook, "application/json", bytes.NewReader(payload))
+	if err == nil {
+		_ = response.Body.Close()
+		if response.StatusCode >= 300 {
+			err = fmt.Errorf("status %s", response.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("Sending an alert of rule %s to its webhook failed: %s", ruleId, err)
+		receiver.metrics.incrementCounter("sensor_manager_failed_webhooks_total", "rule", ruleId)
+	}
+}
+
+// must be called with the lock held
+func (receiver *AlertEngine) toResponse(rule AlertRule, source string) AlertRuleResponse {
+	response := AlertRuleResponse{AlertRule: rule, Source: source, Firing: []FiringAlert{}}
+	for _, status := range receiver.statuses[rule.Id] {
+		if status.firing {
+			response.Firing = append(response.Firing, FiringAlert{SensorId: status.sensorId, Quantity: status.quantity, Since: status.since})
+		}
+	}
+	sort.Slice(response.Firing, func(i, j int) bool {
+		left, right := response.Firing[i], response.Firing[j]
+		return left.SensorId < right.SensorId || (left.SensorId == right.SensorId && left.Quantity < right.Quantity)
+	})
+	return response
+}
+
+func (receiver *AlertEngine) list() []AlertRuleResponse {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	result := []AlertRuleResponse{}
+	for _, rule := range receiver.rulesLocked() {
+		source := AlertRuleSourceApi
+		if _, ok := receiver.configRules[rule.Id]; ok {
+			source = AlertRuleSourceConfig
+		}
+		result = append(result, receiver.toResponse(rule, source))
+	}
+	return result
+}
+
+func (receiver *AlertEngine) get(ruleId string) (AlertRuleResponse, bool) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if rule, ok := receiver.configRules[ruleId]; ok {
+		return receiver.toResponse(rule, AlertRuleSourceConfig), true
+	}
+	if rule, ok := receiver.apiRules[ruleId]; ok {
+		return receiver.toResponse(rule, AlertRuleSourceApi), true
+	}
+	return AlertRuleResponse{}, false
+}
+
+// adds or replaces a rule; a replaced rule starts over, without resolving what it had firing
+func (receiver *AlertEngine) put(rule AlertRule, mustBeNew bool) (status int, err error) {
+	rule, err = rule.normalized()
+	if err != nil {
+		return 400, err
+	}
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if _, ok := receiver.configRules[rule.Id]; ok {
+		return 409, fmt.Errorf("alert rule %s is defined in the config file", rule.Id)
+	}
+	_, exists := receiver.apiRules[rule.Id]
+	if exists && mustBeNew {
+		return 409, fmt.Errorf("alert rule %s already exists", rule.Id)
+	}
+	receiver.apiRules[rule.Id] = rule
+	delete(receiver.statuses, rule.Id)
+	receiver.indexRulesLocked()
+	receiver.writeToFile()
+	log.Printf("Alert rule %s saved.", rule.Id)
+	if exists {
+		return 200, nil
+	}
+	return 201, nil
+}
+
+func (receiver *AlertEngine) remove(ruleId string) (status int, err error) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if _, ok := receiver.configRules[ruleId]; ok {
+		return 409, fmt.Errorf("alert rule %s is defined in the config file", ruleId)
+	}
+	if _, ok := receiver.apiRules[ruleId]; !ok {
+		return 404, fmt.Errorf("no alert rule %s", ruleId)
+	}
+	delete(receiver.apiRules, ruleId)
+	delete(receiver.statuses, ruleId)
+	receiver.indexRulesLocked()
+	receiver.writeToFile()
+	log.Printf("Alert rule %s deleted.", ruleId)
+	return 204, nil
+}
+
+func decodeAlertRule(request *http.Request) (AlertRule, error) {
+	rule := AlertRule{}
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return rule, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		return rule, fmt.Errorf("cannot parse the alert rule: %s", err)
+	}
+	return rule, nil
+}
+
+// GET and POST on the collection, GET, PUT and DELETE on /<rule ID>
+func handleAlertRules(authDb *AuthDatabase, alerts *AlertEngine) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if status, err := authorizeAdmin(request, authDb); err != nil {
+			writeError(writer, request, status, err)
+			return
+		}
+		ruleId := strings.Trim(strings.TrimPrefix(request.URL.Path, ApiAdminRulesPath), "/")
+		switch {
+		case ruleId == "" && request.Method == "GET":
+			writeJson(writer, request, 200, alerts.list())
+		case ruleId == "" && request.Method == "POST":
+			rule, err := decodeAlertRule(request)
+			if err != nil {
+				writeError(writer, request, 400, err)
+				return
+			}
+			if status, err := alerts.put(rule, true); err != nil {
+				writeError(writer, request, status, err)
+				return
+			}
+			response, _ := alerts.get(rule.Id)
+			writeJson(writer, request, 201, response)
+		case ruleId != "" && request.Method == "GET":
+			response, ok := alerts.get(ruleId)
+			if !ok {
+				writeError(writer, request, 404, fmt.Errorf("no alert rule %s", ruleId))
+				return
+			}
+			writeJson(writer, request, 200, response)
+		case ruleId != "" && request.Method == "PUT":
+			rule, err := decodeAlertRule(request)
+			if err != nil {
+				writeError(writer, request, 400, err)
+				return
+			}
+			if rule.Id == "" {
+				rule.Id = ruleId
+			}
+			if rule.Id != ruleId {
+				writeError(writer, request, 400, fmt.Errorf("the rule ID %s does not match the path", rule.Id))
+				return
+			}
+			status, err := alerts.put(rule, false)
+			if err != nil {
+				writeError(writer, request, status, err)
+				return
+			}
+			response, _ := alerts.get(rule.Id)
+			writeJson(writer, request, status, response)
+		case ruleId != "" && request.Method == "DELETE":
+			if status, err := alerts.remove(ruleId); err != nil {
+				writeError(writer, request, status, err)
+				return
+			}
+			writer.WriteHeader(204)
+		default:
+			writeError(writer, request, 405, fmt.Errorf("method %s not allowed", request.Method))
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package sensormanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const ApiSensorListPath = "/api/v1/sensors"
+const ApiSensorsPath = ApiSensorListPath + "/"
+const ApiAdminMetricsPath = "/api/v1/admin/metrics"
+const ApiAdminRejectionsPath = "/api/v1/admin/rejections"
+const ApiAdminRulesPath = "/api/v1/admin/rules"
+
+func writeJson(writer http.ResponseWriter, request *http.Request, status int, value interface{}) {
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		writer.WriteHeader(500)
+		log.Printf("%s (500) -> %s", request.URL.Path, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_, err = writer.Write(serialized)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeError(writer http.ResponseWriter, request *http.Request, status int, err error) {
+	log.Printf("%s (%d) -> %s", request.URL.Path, status, err)
+	writeJson(writer, request, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// sensor IDs cannot contain slashes, see InvalidSensorIdCharacters, so the first segment is the ID
+func splitSensorPath(request *http.Request) (sensorId string, endpoint string) {
+	parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, ApiSensorsPath), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// mirrors the MQTT ACL: whoever may subscribe to one of the sensor's topics may read its data through the API
+// the readable topics are returned, the sensor's first topic first
+func authorizeSensorRead(request *http.Request, authDb *AuthDatabase, sensorId string) (readable []SensorTopic, status int, err error) {
+	username, password := getCredentialsFromRequest(request)
+	if !authDb.isAuthenticated(username, password) {
+		return nil, 401, fmt.Errorf("not authenticated")
+	}
+	topics := authDb.getSensorTopics(sensorId)
+	if len(topics) == 0 {
+		// only tell those that may see everything that the sensor does not exist
+		if authDb.isSuperuserPreauthenticated(username) {
+			return nil, 404, fmt.Errorf("no topic for sensor %s", sensorId)
+		}
+		return nil, 403, fmt.Errorf("user %s may not read sensor %s", username, sensorId)
+	}
+	for _, topic := range topics {
+		if authDb.isAuthorized(username, topic.Name, MqttAuthAccessTypeSubscribe) {
+			readable = append(readable, topic)
+		}
+	}
+	if len(readable) == 0 {
+		return nil, 403, fmt.Errorf("user %s may not read sensor %s", username, sensorId)
+	}
+	return readable, 200, nil
+}
+
+// the sensor's first readable topic if no quantity is requested
+func selectSensorTopic(readable []SensorTopic, quantity string) (SensorTopic, bool) {
+	if quantity == "" {
+		return readable[0], true
+	}
+	for _, topic := range readable {
+		if isSameQuantity(topic.Quantity, quantity) {
+			return topic, true
+		}
+	}
+	return SensorTopic{}, false
+}
+
+func authorizeAdmin(request *http.Request, authDb *AuthDatabase) (status int, err error) {
+	username, password := getCredentialsFromRequest(request)
+	if !authDb.isAuthenticated(username, password) {
+		return 401, fmt.Errorf("not authenticated")
+	}
+	if !authDb.isSuperuser(username, password) {
+		return 403, fmt.Errorf("user %s is not an administrator", username)
+	}
+	return 200, nil
+}
+
+func handleMetrics(authDb *AuthDatabase, metrics *Metrics) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if status, err := authorizeAdmin(request, authDb); err != nil {
+			writeError(writer, request, status, err)
+			return
+		}
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writer.WriteHeader(200)
+		if _, err := writer.Write([]byte(metrics.format())); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// the same as on the dead letter topic, newest first; limit is optional
+func handleRecentRejections(authDb *AuthDatabase, deadLetters *DeadLetterLog) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if status, err := authorizeAdmin(request, authDb); err != nil {
+			writeError(writer, request, status, err)
+			return
+		}
+		limit := 0
+		if limitString := request.URL.Query().Get("limit"); limitString != "" {
+			parsed, err := strconv.Atoi(limitString)
+			if err != nil || parsed < 0 {
+				writeError(writer, request, 400, fmt.Errorf("cannot parse limit '%s' as a non-negative integer", limitString))
+				return
+			}
+			limit = parsed
+		}
+		writeJson(writer, request, 200, deadLetters.recent(limit))
+	}
+}
+
+func parseSensorRegistryFilter(request *http.Request) (SensorRegistryFilter, error) {
+	query := request.URL.Query()
+	filter := SensorRegistryFilter{
+		Quantity:      query.Get("quantity"),
+		SensorType:    query.Get("type"),
+		HardwareModel: query.Get("hardwareModel"),
+	}
+	if aliveString := query.Get("alive"); aliveString != "" {
+		alive, err := strconv.ParseBool(aliveString)
+		if err != nil {
+			return filter, fmt.Errorf("cannot parse alive filter '%s' as a boolean", aliveString)
+		}
+		filter.Alive = &alive
+	}
+	return filter, nil
+}
+
+// everyone sees the sensors whose topics they may subscribe to
+func handleSensorList(authDb *AuthDatabase, registry *SensorRegistry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" {
+			writeError(writer, request, 405, fmt.Errorf("method %s not allowed", request.Method))
+			return
+		}
+		username, password := getCredentialsFromRequest(request)
+		if !authDb.isAuthenticated(username, password) {
+			writeError(writer, request, 401, fmt.Errorf("not authenticated"))
+			return
+		}
+		filter, err := parseSensorRegistryFilter(request)
+		if err != nil {
+			writeError(writer, request, 400, err)
+			return
+		}
+		writeJson(writer, request, 200, registry.list(filter, func(topicName string) bool {
+			return authDb.isAuthorized(username, topicName, MqttAuthAccessTypeSubscribe)
+		}))
+	}
+}
+
+// replays are started with POST, everything else is read with GET
+func handleSensorApi(authDb *AuthDatabase, latestValues *LatestValueCache, registry *SensorRegistry, history *HistoryStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sensorId, endpoint := splitSensorPath(request)
+		allowedMethod := "GET"
+		if endpoint == "replay" {
+			allowedMethod = "POST"
+		}
+		if request.Method != allowedMethod {
+			writeError(writer, request, 405, fmt.Errorf("method %s not allowed", request.Method))
+			return
+		}
+		if sensorId == "" {
+			writeError(writer, request, 400, fmt.Errorf("invalid sensor ID in %s", request.URL.Path))
+			return
+		}
+		readable, status, err := authorizeSensorRead(request, authDb, sensorId)
+		if err != nil {
+			writeError(writer, request, status, err)
+			return
+		}
+
+		switch endpoint {
+		case "":
+			sensor, ok := registry.get(sensorId)
+			if !ok {
+				writeError(writer, request, 404, fmt.Errorf("no message received for sensor %s yet", sensorId))
+				return
+			}
+			writeJson(writer, request, 200, sensor)
+		case "latest":
+			quantity := request.URL.Query().Get("quantity")
+			topic, ok := selectSensorTopic(readable, quantity)
+			if !ok {
+				writeError(writer, request, 404, fmt.Errorf("no readable quantity %s for sensor %s", quantity, sensorId))
+				return
+			}
+			latest, ok := latestValues.get(topic.Name)
+			if !ok {
+				writeError(writer, request, 404, fmt.Errorf("no value received for sensor %s yet", sensorId))
+				return
+			}
+			writeJson(writer, request, 200, latest)
+		case "history", "replay":
+			quantity := request.URL.Query().Get("quantity")
+			topic, ok := selectSensorTopic(readable, quantity)
+			if !ok {
+				writeError(writer, request, 404, fmt.Errorf("no readable quantity %s for sensor %s", quantity, sensorId))
+				return
+			}
+			from, to, step, err := parseHistoryRange(request)
+			if err != nil {
+				writeError(writer, request, 400, err)
+				return
+			}
+			if endpoint == "replay" {
+				username, _ := getCredentialsFromRequest(request)
+				response, status, err := history.queueReplay(authDb, topic, username, from, to)
+				if err != nil {
+					writeError(writer, request, status, err)
+					return
+				}
+				writeJson(writer, request, 202, response)
+				return
+			}
+			points, complete, err := history.query(topic.SensorId, topic.Quantity, from, to, step)
+			if err != nil {
+				writeError(writer, request, 500, err)
+				return
+			}
+			if !complete {
+				writeError(writer, request, 400, fmt.Errorf("more than %d values in the range; narrow the range or set a step", HistoryQueryMaxPoints))
+				return
+			}
+			unit := ""
+			if quantity, ok := lookupQuantity(topic.Quantity); ok {
+				unit = quantity.CanonicalUnit
+			}
+			writeJson(writer, request, 200, HistoryResponse{SensorId: topic.SensorId, Quantity: topic.Quantity, Values: toOutgoingMessages(points, unit)})
+		default:
+			writeError(writer, request, 404, fmt.Errorf("unknown endpoint %s", request.URL.Path))
+		}
+	}
+}
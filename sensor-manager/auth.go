@@ -10,7 +10,10 @@ import (
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 const SuperuserUsername = "system"
@@ -26,20 +29,36 @@ type SensorTopic struct {
 	Quantity string `json:"quantity"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// suffixes of derived topics subscribers asked for, e.g. in/°F, see variants.go
+	Variants []string `json:"variants,omitempty"`
+	// still published on after a rename, see topiclayout.go
+	LegacyNames []LegacyTopicName `json:"legacyNames,omitempty"`
+	// what the topic was named with, for readings that leave them out
+	HardwareModel string `json:"hardwareModel,omitempty"`
+	SensorType    string `json:"sensorType,omitempty"`
 }
 
 type AuthDatabase struct {
 	// big ugly hack
 	Filename string
-	// maps sensor IDs to topics
+	// maps sensor IDs to topics, further quantities of a sensor are keyed with buildSensorTopicKey
 	Topics map[string]SensorTopic
 	// authenticates system services, also a big ugly hack
 	AdministratorAccessToken string
 	// authenticates sensor drivers, also a big ugly hack
 	SensorDriverAccessToken string
+	// the database is passed by value, so the lock is shared through a pointer
+	lock   *sync.RWMutex
+	layout TopicLayout
+	// replay topics and the users who requested them, see history.go; not persisted, as replays do not survive a restart
+	replayRequesters map[string]string
+	// when each variant was last requested, by topic key and suffix; not persisted, see removeIdleVariants
+	variantRequests map[string]time.Time
+	// guards variantRequests only, so requests of existing variants do not need the write lock
+	variantLock *sync.Mutex
 }
 
-func LoadOrCreateAuthDatabase(filename string, administratorAccessToken string, sensorDriverAccessToken string) AuthDatabase {
+func LoadOrCreateAuthDatabase(filename string, administratorAccessToken string, sensorDriverAccessToken string, layout TopicLayout) AuthDatabase {
 	contents, err := ioutil.ReadFile(filename)
 	if err != nil {
 		log.Printf("Reading auth database file %s failed, creating anew.", filename)
@@ -48,6 +67,11 @@ func LoadOrCreateAuthDatabase(filename string, administratorAccessToken string,
 			Topics:                   map[string]SensorTopic{},
 			AdministratorAccessToken: administratorAccessToken,
 			SensorDriverAccessToken:  sensorDriverAccessToken,
+			lock:                     &sync.RWMutex{},
+			layout:                   layout,
+			replayRequesters:         map[string]string{},
+			variantRequests:          map[string]time.Time{},
+			variantLock:              &sync.Mutex{},
 		}
 		err = os.MkdirAll(path.Dir(filename), 0776)
 		if err != nil {
@@ -64,6 +88,11 @@ func LoadOrCreateAuthDatabase(filename string, administratorAccessToken string,
 		log.Println(fmt.Errorf("failed to unmarshal database, panic"))
 		panic(err)
 	}
+	unmarshaled.lock = &sync.RWMutex{}
+	unmarshaled.layout = layout
+	unmarshaled.replayRequesters = map[string]string{}
+	unmarshaled.variantRequests = map[string]time.Time{}
+	unmarshaled.variantLock = &sync.Mutex{}
 	// always overwrite
 	unmarshaled.AdministratorAccessToken = administratorAccessToken
 	unmarshaled.SensorDriverAccessToken = sensorDriverAccessToken
@@ -71,17 +100,6 @@ func LoadOrCreateAuthDatabase(filename string, administratorAccessToken string,
 	return unmarshaled
 }
 
-func buildTopicFromSensorId(unsafe string) string {
-	sanitised := strings.Map(func(c rune) rune {
-		if (47 <= c && c <= 57) || (65 <= c && c <= 90) || (97 <= c && c <= 122) {
-			return c
-		} else {
-			return '_'
-		}
-	}, unsafe)
-	return TopicClientPublishRoot + sanitised
-}
-
 func generateRandomString() string {
 	base := make([]byte, GeneratedTokenLengthBytes)
 	_, err := rand.Read(base)
@@ -101,6 +119,7 @@ func generateUsernamePassword() (username string, password string) {
 	return generateRandomString(), generateRandomString()
 }
 
+// must be called with the lock held (or before the database is shared)
 func (db AuthDatabase) writeToFile() {
 	serialized, err := json.Marshal(db)
 	if err != nil {
@@ -113,30 +132,280 @@ func (db AuthDatabase) writeToFile() {
 	}
 }
 
-func (db AuthDatabase) addSensorTopic(sensorId string, quantity string) (topicName string, err error) {
-	if _, ok := db.Topics[sensorId]; ok {
-		return "", fmt.Errorf("sensor ID already exists: %s", sensorId)
+// the first quantity of a sensor is keyed by the sensor ID alone, as before multi-quantity messages
+// further quantities get their own key and a topic below the sensor's topic; sensor IDs cannot contain #, so keys are unique
+func buildSensorTopicKey(sensorId string, quantity string) string {
+	return sensorId + "#" + quantity
+}
+
+// the reading's metadata is completed
+func (receiver SensorTopic) isUpToDate(layout TopicLayout, key string, reading IncomingSensorMessage) bool {
+	return receiver.Name == layout.buildTopicName(reading, key == reading.SensorId) &&
+		receiver.HardwareModel == reading.HardwareModel && receiver.SensorType == reading.SensorType
+}
+
+// empty metadata in a reading is unknown, not changed, so the topic keeps what it was named with
+func (receiver SensorTopic) completeMetadata(reading IncomingSensorMessage) IncomingSensorMessage {
+	if reading.HardwareModel == "" {
+		reading.HardwareModel = receiver.HardwareModel
+	}
+	if reading.SensorType == "" {
+		reading.SensorType = receiver.SensorType
+	}
+	return reading
+}
+
+// the topic of the reading's sensor and quantity, added or renamed if needed; most readings only need the read lock
+func (db AuthDatabase) resolveSensorTopic(reading IncomingSensorMessage) (SensorTopic, error) {
+	db.lock.RLock()
+	key, topic, ok := db.findSensorTopicLocked(reading.SensorId, reading.Quantity)
+	if ok && topic.isUpToDate(db.layout, key, topic.completeMetadata(reading)) {
+		db.lock.RUnlock()
+		return topic, nil
+	}
+	db.lock.RUnlock()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	// another worker may have added or renamed it in the meantime
+	key, topic, ok = db.findSensorTopicLocked(reading.SensorId, reading.Quantity)
+	if !ok {
+		return db.addSensorTopicLocked(reading)
+	}
+	reading = topic.completeMetadata(reading)
+	name := db.layout.buildTopicName(reading, key == reading.SensorId)
+	if topic.Name == name {
+		if topic.HardwareModel != reading.HardwareModel || topic.SensorType != reading.SensorType {
+			// topics named before their metadata was kept, or metadata the template does not use
+			topic.HardwareModel, topic.SensorType = reading.HardwareModel, reading.SensorType
+			db.Topics[key] = topic
+			db.writeToFile()
+		}
+		return topic, nil
+	}
+	now := time.Now()
+	if owner, ok := db.findNameOwnerLocked(name, key, now); ok {
+		log.Printf("Topic %s of sensor %s is still used by auth database entry %s", name, reading.SensorId, owner)
+	}
+	renamed := topic.renamed(name, db.layout.LegacyWindow, now)
+	// an old name shared with another sensor would keep leaking its values to this sensor's readers
+	legacyNames := []LegacyTopicName{}
+	for _, legacy := range renamed.LegacyNames {
+		if _, shared := db.findNameOwnerLocked(legacy.Name, key, now); !shared {
+			legacyNames = append(legacyNames, legacy)
+		}
+	}
+	renamed.LegacyNames = legacyNames
+	renamed.HardwareModel, renamed.SensorType = reading.HardwareModel, reading.SensorType
+	db.Topics[key] = renamed
+	db.writeToFile()
+	log.Printf("Renamed topic %s of sensor %s to %s", topic.Name, topic.SensorId, renamed.Name)
+	return renamed, nil
+}
+
+func (db AuthDatabase) findNameOwnerLocked(name string, exceptKey string, now time.Time) (string, bool) {
+	for key, topic := range db.Topics {
+		if key == exceptKey {
+			continue
+		}
+		for _, activeName := range topic.activeNames(now) {
+			if activeName == name {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (db AuthDatabase) addSensorTopicLocked(reading IncomingSensorMessage) (SensorTopic, error) {
+	if _, _, ok := db.findSensorTopicLocked(reading.SensorId, reading.Quantity); ok {
+		return SensorTopic{}, fmt.Errorf("sensor ID already exists with quantity %s: %s", reading.Quantity, reading.SensorId)
+	}
+	key := reading.SensorId
+	if _, ok := db.Topics[reading.SensorId]; ok {
+		key = buildSensorTopicKey(reading.SensorId, reading.Quantity)
+	}
+	name := db.layout.buildTopicName(reading, key == reading.SensorId)
+	if owner, ok := db.findNameOwnerLocked(name, key, time.Now()); ok {
+		log.Printf("Topic %s of sensor %s is still used by auth database entry %s", name, reading.SensorId, owner)
 	}
 	username, password := generateUsernamePassword()
 	newTopic := SensorTopic{
-		SensorId: sensorId,
-		Name:     buildTopicFromSensorId(sensorId),
-		Quantity: quantity,
+		SensorId: reading.SensorId,
+		Name:     name,
+		Quantity: reading.Quantity,
 		Username: username,
 		Password: password,
+		// see completeMetadata
+		HardwareModel: reading.HardwareModel,
+		SensorType:    reading.SensorType,
 	}
-	db.Topics[sensorId] = newTopic
+	db.Topics[key] = newTopic
 	db.writeToFile()
 	log.Printf("Added topic %s for sensor %s", newTopic.Name, newTopic.SensorId)
-	return newTopic.Name, nil
+	return newTopic, nil
 }
 
+// the sensor's first topic
 func (db AuthDatabase) getTopicForSensor(sensorId string) (topicName string, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	topic, ok := db.Topics[sensorId]
 	if !ok {
 		return "", fmt.Errorf("no topic for sensor %s", sensorId)
-	} else {
-		return topic.Name, nil
+	}
+	return topic.Name, nil
+}
+
+func (db AuthDatabase) getSensorTopic(sensorId string, quantity string) (SensorTopic, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	_, topic, ok := db.findSensorTopicLocked(sensorId, quantity)
+	if !ok {
+		return SensorTopic{}, fmt.Errorf("no topic for quantity %s of sensor %s", quantity, sensorId)
+	}
+	return topic, nil
+}
+
+// quantities stored before they were normalized may be aliases, so they are compared by definition
+func (db AuthDatabase) findSensorTopicLocked(sensorId string, quantity string) (key string, topic SensorTopic, ok bool) {
+	for _, key := range []string{sensorId, buildSensorTopicKey(sensorId, quantity)} {
+		topic, ok := db.Topics[key]
+		if ok && topic.SensorId == sensorId && isSameQuantity(topic.Quantity, quantity) {
+			return key, topic, true
+		}
+	}
+	return "", SensorTopic{}, false
+}
+
+// the first topic comes first
+func (db AuthDatabase) getSensorTopics(sensorId string) []SensorTopic {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	topics := []SensorTopic{}
+	for key, topic := range db.Topics {
+		if topic.SensorId == sensorId && key != sensorId {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	if topic, ok := db.Topics[sensorId]; ok {
+		topics = append([]SensorTopic{topic}, topics...)
+	}
+	return topics
+}
+
+// a copy, safe to iterate while topics are added
+func (db AuthDatabase) copyTopics() map[string]SensorTopic {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	copied := make(map[string]SensorTopic, len(db.Topics))
+	for sensorId, topic := range db.Topics {
+		copied[sensorId] = topic
+	}
+	return copied
+}
+
+// must be called with the lock held
+func (db AuthDatabase) findTopicByNameLocked(topicName string, now time.Time) (key string, topic SensorTopic, ok bool) {
+	for dbKey, dbTopic := range db.Topics {
+		for _, name := range dbTopic.activeNames(now) {
+			if name == topicName {
+				key, topic, ok = dbKey, dbTopic, true
+			}
+		}
+	}
+	return
+}
+
+func hasVariant(topic SensorTopic, suffix string) bool {
+	for _, existing := range topic.Variants {
+		if existing == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+func (db AuthDatabase) noteVariantRequest(key string, suffix string, now time.Time) {
+	db.variantLock.Lock()
+	defer db.variantLock.Unlock()
+	db.variantRequests[key+"/"+suffix] = now
+}
+
+// called for every ACL check of a variant, so existing ones are looked up under the read lock;
+// false if the topic is unknown or has as many variants as the layout allows
+func (db AuthDatabase) addTopicVariant(topicName string, suffix string) bool {
+	now := time.Now()
+	db.lock.RLock()
+	key, topic, ok := db.findTopicByNameLocked(topicName, now)
+	db.lock.RUnlock()
+	if ok && hasVariant(topic, suffix) {
+		db.noteVariantRequest(key, suffix, now)
+		return true
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	// another request may have added it in the meantime
+	key, topic, ok = db.findTopicByNameLocked(topicName, now)
+	if !ok {
+		return false
+	}
+	if !hasVariant(topic, suffix) {
+		if len(topic.Variants) >= db.layout.MaxVariants {
+			log.Printf("Denied variant %s/%s for sensor %s, the topic has %d variants already.", topic.Name, suffix, topic.SensorId, len(topic.Variants))
+			return false
+		}
+		topic.Variants = append(topic.Variants, suffix)
+		db.Topics[key] = topic
+		db.writeToFile()
+		log.Printf("Added variant %s/%s for sensor %s", topic.Name, suffix, topic.SensorId)
+	}
+	db.noteVariantRequest(key, suffix, now)
+	return true
+}
+
+// variants loaded from the file count as requested when first checked, as requests are not persisted
+func (db AuthDatabase) removeIdleVariants(now time.Time) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.variantLock.Lock()
+	defer db.variantLock.Unlock()
+	changed := false
+	for key, topic := range db.Topics {
+		kept := []string{}
+		for _, suffix := range topic.Variants {
+			requestKey := key + "/" + suffix
+			requestedAt, ok := db.variantRequests[requestKey]
+			if !ok {
+				db.variantRequests[requestKey] = now
+				requestedAt = now
+			}
+			if now.Sub(requestedAt) > db.layout.VariantIdleTimeout {
+				delete(db.variantRequests, requestKey)
+				log.Printf("Removed variant %s/%s for sensor %s, not requested since %s", topic.Name, suffix, topic.SensorId, requestedAt.Format(time.RFC3339))
+				continue
+			}
+			kept = append(kept, suffix)
+		}
+		if len(kept) != len(topic.Variants) {
+			topic.Variants = kept
+			db.Topics[key] = topic
+			changed = true
+		}
+	}
+	if changed {
+		db.writeToFile()
+	}
+}
+
+// the broker asks for every delivery, up to its ACL cache time, so variants with subscribers keep being requested
+func (db AuthDatabase) RemoveIdleVariantsPeriodically() {
+	for now := range time.Tick(TopicVariantIdleCheckInterval) {
+		db.removeIdleVariants(now)
 	}
 }
 
@@ -145,6 +414,8 @@ func (db AuthDatabase) isAuthenticated(username string, password string) bool {
 	if db.isSuperuser(username, password) || db.isSensorDriver(username, password) {
 		return true
 	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	for _, dbTopic := range db.Topics {
 		if constantTimeStringEqual(username, dbTopic.Username) && constantTimeStringEqual(password, dbTopic.Password) {
 			return true
@@ -158,6 +429,11 @@ func (db AuthDatabase) isAuthenticated(username string, password string) bool {
 // the password is not available here, as this is only called when authentication passes
 func (db AuthDatabase) isAuthorized(username string, topic string, accessType int) bool {
 	if db.isSuperuserPreauthenticated(username) {
+		if accessType != MqttAuthAccessTypePublish {
+			if base, suffix, ok := db.findVariantBase(topic); ok {
+				db.addTopicVariant(base.Name, suffix)
+			}
+		}
 		return true
 	}
 	if constantTimeStringEqual(username, SensorDriverUsername) && constantTimeStringEqual(topic, TopicSensorReceive) {
@@ -167,9 +443,67 @@ func (db AuthDatabase) isAuthorized(username string, topic string, accessType in
 	if accessType == MqttAuthAccessTypePublish {
 		return false
 	}
+	if db.isAuthorizedForTopic(username, topic) {
+		return true
+	}
+	// derived topics are created on demand for those who may read the base topic
+	if base, suffix, ok := db.findVariantBase(topic); ok && db.isAuthorizedForTopic(username, base.Name) {
+		return db.addTopicVariant(base.Name, suffix)
+	}
+	// the liveness of the sensor, see liveness.go
+	if base := strings.TrimSuffix(topic, "/"+TopicSuffixStatus); base != topic && db.isAuthorizedForTopic(username, base) {
+		return true
+	}
+	// replays of its history, only for the user who requested them, see history.go; a filter like <topic>/# is granted
+	// for the base topic, but filters never match a replay here and the broker checks every delivery of one again
+	if db.isReplayRequester(username, topic) {
+		return true
+	}
+	return false
+}
+
+func (db AuthDatabase) grantReplay(topic string, username string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.replayRequesters[topic] = username
+}
+
+func (db AuthDatabase) revokeReplay(topic string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.replayRequesters, topic)
+}
+
+func (db AuthDatabase) isReplayRequester(username string, topic string) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	requester, ok := db.replayRequesters[topic]
+	return ok && constantTimeStringEqual(username, requester)
+}
+
+// like isAuthorized for subscribers, but without creating variants, for topics that are published already
+func (db AuthDatabase) isAuthorizedToRead(username string, topic string) bool {
+	if db.isSuperuserPreauthenticated(username) || db.isAuthorizedForTopic(username, topic) {
+		return true
+	}
+	base, _, ok := db.findVariantBase(topic)
+	return ok && db.isAuthorizedForTopic(username, base.Name)
+}
+
+// renamed topics stay readable under their old names for a while
+// a wildcard filter is granted if it matches any of the user's topics, as the broker checks every delivery again
+func (db AuthDatabase) isAuthorizedForTopic(username string, topic string) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	now := time.Now()
 	for _, dbTopic := range db.Topics {
-		if constantTimeStringEqual(topic, dbTopic.Name) && constantTimeStringEqual(username, dbTopic.Username) {
-			return true
+		if !constantTimeStringEqual(username, dbTopic.Username) {
+			continue
+		}
+		for _, name := range dbTopic.activeNames(now) {
+			if constantTimeStringEqual(topic, name) || (isTopicFilter(topic) && topicMatchesFilter(topic, name)) {
+				return true
+			}
 		}
 	}
 	return false
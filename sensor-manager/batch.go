@@ -0,0 +1,85 @@
+package sensormanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mf2c-sensor-manager/codec"
+)
+
+// many readings in one message, for drivers publishing at high rates
+// readings are validated and published in order, an invalid one does not affect the others
+type IncomingSensorBatch = codec.Batch
+
+// the format is detected, see codec.Detect
+func decodeIncomingPayload(payload []byte, maxBatchSize int) (messages []IncomingSensorMessage, format codec.Format, isBatch bool, rejection *MessageRejection) {
+	format, batch, isBatch, err := codec.Decode(payload)
+	if err != nil {
+		return nil, format, isBatch, decodeErrorRejection(err)
+	}
+	if !isBatch {
+		return batch.Readings, format, false, nil
+	}
+	if len(batch.Readings) == 0 {
+		return nil, format, true, reject(RejectionEmptyBatch, "the batch contains no readings")
+	}
+	if maxBatchSize > 0 && len(batch.Readings) > maxBatchSize {
+		return nil, format, true, reject(RejectionBatchTooLarge, "the batch contains %d readings, at most %d are allowed", len(batch.Readings), maxBatchSize)
+	}
+	for i := range batch.Readings {
+		if batch.Readings[i].HardwareModel == "" {
+			batch.Readings[i].HardwareModel = batch.HardwareModel
+		}
+	}
+	return batch.Readings, format, true, nil
+}
+
+// the rejection of one reading of a batch, with the reading as payload of the dead letter
+func rejectBatchReading(index int, reading IncomingSensorMessage, rejection *MessageRejection) ([]byte, *MessageRejection) {
+	payload, err := json.Marshal(reading)
+	if err != nil {
+		payload = []byte(err.Error())
+	}
+	return payload, &MessageRejection{Reason: rejection.Reason, Detail: fmt.Sprintf("reading %d of the batch: %s", index, rejection.Detail)}
+}
+
+type outgoingBatch struct {
+	topic  string
+	policy PublishPolicy
+	format codec.Format
+	// SenML record name
+	name     string
+	messages []OutgoingClientMessage
+}
+
+// collects the values for batch variants while an incoming message is processed, in order of appearance
+type outgoingBatches struct {
+	batches []*outgoingBatch
+	byTopic map[string]*outgoingBatch
+}
+
+func newOutgoingBatches() *outgoingBatches {
+	return &outgoingBatches{byTopic: map[string]*outgoingBatch{}}
+}
+
+func (receiver *outgoingBatches) add(topic string, policy PublishPolicy, format codec.Format, name string, message OutgoingClientMessage) {
+	batch, ok := receiver.byTopic[topic]
+	if !ok {
+		batch = &outgoingBatch{topic: topic, policy: policy, format: format, name: name}
+		receiver.byTopic[topic] = batch
+		receiver.batches = append(receiver.batches, batch)
+	}
+	batch.messages = append(batch.messages, message)
+}
+
+// batch variants are not streamed over HTTP, streams get every value anyway
+func (receiver *outgoingBatches) publish(publisher *Publisher) {
+	for _, batch := range receiver.batches {
+		marshaled, err := codec.EncodeValues(batch.format, batch.name, batch.messages)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		publisher.publish(batch.topic, batch.policy, marshaled)
+	}
+}
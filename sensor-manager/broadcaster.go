@@ -0,0 +1,66 @@
+package sensormanager
+
+import (
+	"log"
+	"sync"
+)
+
+// how many messages a slow HTTP stream may lag behind before messages are dropped for it
+const BroadcastSubscriptionBufferSize = 64
+
+// what is sent to HTTP stream clients, as they may listen to several topics at once
+type StreamedClientMessage struct {
+	Topic   string
+	Message OutgoingClientMessage
+}
+
+type broadcastSubscription struct {
+	// decides which topics this subscriber receives; checked once per message
+	accepts  func(topic string) bool
+	messages chan StreamedClientMessage
+}
+
+// fans outgoing messages out to HTTP stream clients, so they do not need their own MQTT connection
+type ValueBroadcaster struct {
+	lock          sync.RWMutex
+	subscriptions map[*broadcastSubscription]struct{}
+}
+
+func NewValueBroadcaster() *ValueBroadcaster {
+	return &ValueBroadcaster{
+		subscriptions: map[*broadcastSubscription]struct{}{},
+	}
+}
+
+func (receiver *ValueBroadcaster) subscribe(accepts func(topic string) bool) *broadcastSubscription {
+	subscription := &broadcastSubscription{
+		accepts:  accepts,
+		messages: make(chan StreamedClientMessage, BroadcastSubscriptionBufferSize),
+	}
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	receiver.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+func (receiver *ValueBroadcaster) unsubscribe(subscription *broadcastSubscription) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	delete(receiver.subscriptions, subscription)
+}
+
+// never blocks: the MQTT callback must not wait for HTTP clients
+func (receiver *ValueBroadcaster) publish(topic string, message OutgoingClientMessage) {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	for subscription := range receiver.subscriptions {
+		if !subscription.accepts(topic) {
+			continue
+		}
+		select {
+		case subscription.messages <- StreamedClientMessage{Topic: topic, Message: message}:
+		default:
+			log.Printf("HTTP stream client is too slow, dropping a message on %s.", topic)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package sensormanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const ApiAdminCalibrationsPath = "/api/v1/admin/calibrations"
+
+type CalibrationKind string
+
+const (
+	// value * Scale + Offset
+	CalibrationKindLinear CalibrationKind = "linear"
+	// Coefficients[0] + Coefficients[1] * value + Coefficients[2] * value² + ...
+	CalibrationKindPolynomial CalibrationKind = "polynomial"
+	// linear interpolation between the points, the outermost ones are extended beyond the table
+	CalibrationKindTable CalibrationKind = "table"
+)
+
+// corrects the values of one quantity of a sensor; values are in the canonical unit of the quantity
+type CalibrationProfile struct {
+	Kind   CalibrationKind `json:"kind"`
+	Offset float64         `json:"offset,omitempty"`
+	// 1 if not set
+	Scale        *float64           `json:"scale,omitempty"`
+	Coefficients []float64          `json:"coefficients,omitempty"`
+	Points       []CalibrationPoint `json:"points,omitempty"`
+	// the uncorrected value is published as RawValue as well
+	KeepRaw bool `json:"keepRaw,omitempty"`
+}
+
+type CalibrationPoint struct {
+	Raw       float64 `json:"raw"`
+	Corrected float64 `json:"corrected"`
+}
+
+// the calibrations of one sensor, by quantity
+type SensorCalibration map[string]CalibrationProfile
+
+// points are sorted by raw value
+func (receiver CalibrationProfile) normalized() (CalibrationProfile, error) {
+	switch receiver.Kind {
+	case CalibrationKindLinear:
+		if len(receiver.Coefficients) > 0 || len(receiver.Points) > 0 {
+			return receiver, fmt.Errorf("a linear calibration takes offset and scale only")
+		}
+	case CalibrationKindPolynomial:
+		if len(receiver.Coefficients) == 0 || receiver.Offset != 0 || receiver.Scale != nil || len(receiver.Points) > 0 {
+			return receiver, fmt.Errorf("a polynomial calibration takes coefficients only, at least one")
+		}
+	case CalibrationKindTable:
+		if len(receiver.Points) < 2 || receiver.Offset != 0 || receiver.Scale != nil || len(receiver.Coefficients) > 0 {
+			return receiver, fmt.Errorf("a table calibration takes points only, at least two")
+		}
+		points := append([]CalibrationPoint{}, receiver.Points...)
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].Raw < points[j].Raw
+		})
+		for i := 1; i < len(points); i++ {
+			if points[i].Raw == points[i-1].Raw {
+				return receiver, fmt.Errorf("the table has two points for raw value %g", points[i].Raw)
+			}
+		}
+		receiver.Points = points
+	default:
+		return receiver, fmt.Errorf("unknown calibration kind '%s', must be %s, %s or %s", receiver.Kind, CalibrationKindLinear, CalibrationKindPolynomial, CalibrationKindTable)
+	}
+	return receiver, nil
+}
+
+func (receiver CalibrationProfile) apply(value float64) float64 {
+	switch receiver.Kind {
+	case CalibrationKindLinear:
+		scale := 1.0
+		if receiver.Scale != nil {
+			scale = *receiver.Scale
+		}
+		return value*scale + receiver.Offset
+	case CalibrationKindPolynomial:
+		// Horner's method
+		corrected := 0.0
+		for i := len(receiver.Coefficients) - 1; i >= 0; i-- {
+			corrected = corrected*value + receiver.Coefficients[i]
+		}
+		return corrected
+	case CalibrationKindTable:
+		points := receiver.Points
+		segment := len(points) - 2
+		for i := 1; i < len(points)-1; i++ {
+			if value < points[i].Raw {
+				segment = i - 1
+				break
+			}
+		}
+		left, right := points[segment], points[segment+1]
+		return left.Corrected + (value-left.Raw)*(right.Corrected-left.Corrected)/(right.Raw-left.Raw)
+	}
+	return value
+}
+
+// quantities are normalized
+func (receiver SensorCalibration) normalized() (SensorCalibration, error) {
+	normalized := SensorCalibration{}
+	for quantityName, profile := range receiver {
+		quantity, ok := lookupQuantity(quantityName)
+		if !ok {
+			return nil, fmt.Errorf("unknown quantity %s", quantityName)
+		}
+		if _, ok := normalized[quantity.Name]; ok {
+			return nil, fmt.Errorf("quantity %s is calibrated twice", quantity.Name)
+		}
+		profile, err := profile.normalized()
+		if err != nil {
+			return nil, fmt.Errorf("quantity %s: %s", quantity.Name, err)
+		}
+		normalized[quantity.Name] = profile
+	}
+	return normalized, nil
+}
+
+// the reading is normalized; the raw value is only returned if the profile keeps it, false if the sensor is not calibrated;
+// like incoming values, results that are not finite are rejected
+func (receiver *SensorRegistry) calibrate(reading IncomingSensorMessage) (IncomingSensorMessage, *float64, bool, *MessageRejection) {
+	receiver.lock.RLock()
+	profile, ok := receiver.Calibrations[reading.SensorId][reading.Quantity]
+	receiver.lock.RUnlock()
+	if !ok {
+		return reading, nil, false, nil
+	}
+	raw := reading.Value
+	reading.Value = profile.apply(raw)
+	if math.IsNaN(reading.Value) || math.IsInf(reading.Value, 0) {
+		return reading, nil, true, reject(RejectionNonFiniteValue, "value %f %s of sensor %s is not finite after calibration", raw, reading.Unit, reading.SensorId)
+	}
+	if !profile.KeepRaw {
+		return reading, nil, true, nil
+	}
+	return reading, &raw, true, nil
+}
+
+func (receiver *SensorRegistry) getCalibration(sensorId string) (SensorCalibration, bool) {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	calibration, ok := receiver.Calibrations[sensorId]
+	return calibration, ok
+}
+
+func (receiver *SensorRegistry) listCalibrations() map[string]SensorCalibration {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	result := map[string]SensorCalibration{}
+	for sensorId, calibration := range receiver.Calibrations {
+		result[sensorId] = calibration
+	}
+	return result
+}
+
+// sensors may be calibrated before they send their first message
+func (receiver *SensorRegistry) setCalibration(sensorId string, calibration SensorCalibration) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if len(calibration) == 0 {
+		delete(receiver.Calibrations, sensorId)
+	} else {
+		receiver.Calibrations[sensorId] = calibration
+	}
+	receiver.writeToFile()
+	log.Printf("Calibration of sensor %s set for %d quantities.", sensorId, len(calibration))
+}
+
+// GET on the collection; GET, PUT (all quantities at once) and DELETE on /<URL encoded sensor ID>
+func handleCalibrations(authDb *AuthDatabase, registry *SensorRegistry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if status, err := authorizeAdmin(request, authDb); err != nil {
+			writeError(writer, request, status, err)
+			return
+		}
+		sensorId, err := url.PathUnescape(strings.Trim(strings.TrimPrefix(request.URL.EscapedPath(), ApiAdminCalibrationsPath), "/"))
+		if err != nil {
+			writeError(writer, request, 400, fmt.Errorf("invalid sensor ID in %s", request.URL.EscapedPath()))
+			return
+		}
+		switch {
+		case sensorId == "" && request.Method == "GET":
+			writeJson(writer, request, 200, registry.listCalibrations())
+		case sensorId != "" && request.Method == "GET":
+			calibration, ok := registry.getCalibration(sensorId)
+			if !ok {
+				writeError(writer, request, 404, fmt.Errorf("sensor %s is not calibrated", sensorId))
+				return
+			}
+			writeJson(writer, request, 200, calibration)
+		case sensorId != "" && request.Method == "PUT":
+			body, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				writeError(writer, request, 400, err)
+				return
+			}
+			calibration := SensorCalibration{}
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&calibration); err != nil {
+				writeError(writer, request, 400, fmt.Errorf("cannot parse the calibration: %s", err))
+				return
+			}
+			calibration, err = calibration.normalized()
+			if err != nil {
+				writeError(writer, request, 400, err)
+				return
+			}
+			registry.setCalibration(sensorId, calibration)
+			writeJson(writer, request, 200, calibration)
+		case sensorId != "" && request.Method == "DELETE":
+			if _, ok := registry.getCalibration(sensorId); !ok {
+				writeError(writer, request, 404, fmt.Errorf("sensor %s is not calibrated", sensorId))
+				return
+			}
+			registry.setCalibration(sensorId, nil)
+			writer.WriteHeader(204)
+		default:
+			writeError(writer, request, 405, fmt.Errorf("method %s not allowed", request.Method))
+		}
+	}
+}
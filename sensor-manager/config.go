@@ -0,0 +1,607 @@
+package sensormanager
+
+import (
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"mf2c-sensor-manager/codec"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// precedence: defaults, then the config file, then env vars, then flags
+type Config struct {
+	Mqtt struct {
+		Host string `yaml:"host"`
+		Port int    `yaml:"port"`
+		// passed to sensor drivers, same as the reverse proxy prefix for the broker (or empty)
+		PathSuffix string `yaml:"pathSuffix"`
+	} `yaml:"mqtt"`
+	Http struct {
+		Port int `yaml:"port"`
+		Tls  struct {
+			CertFile              string `yaml:"certFile"`
+			KeyFile               string `yaml:"keyFile"`
+			ClientCaFile          string `yaml:"clientCaFile"`
+			ReloadIntervalSeconds int    `yaml:"reloadIntervalSeconds"`
+		} `yaml:"tls"`
+		// comma-separated, e.g. https://dashboard.example.com; pages of other origins cannot open WebSocket streams
+		AllowedOrigins string `yaml:"allowedOrigins"`
+	} `yaml:"http"`
+	Cimi struct {
+		Host string `yaml:"host"`
+		Port int    `yaml:"port"`
+	} `yaml:"cimi"`
+	Lifecycle struct {
+		Host string `yaml:"host"`
+		Port int    `yaml:"port"`
+	} `yaml:"lifecycle"`
+	Secrets struct {
+		AdministratorAccessToken string `yaml:"administratorAccessToken"`
+		SensorDriverAccessToken  string `yaml:"sensorDriverAccessToken"`
+		ApplicationSecret        string `yaml:"applicationSecret"`
+	} `yaml:"secrets"`
+	AuthDbFile string `yaml:"authDbFile"`
+	// defaults to sensor-registry.json next to the auth DB
+	SensorRegistryFile string `yaml:"sensorRegistryFile"`
+	// sequence numbers of the v2 envelopes; defaults to sequences.json next to the auth DB
+	SequencesFile             string `yaml:"sequencesFile"`
+	SensorAliveTimeoutSeconds int    `yaml:"sensorAliveTimeoutSeconds"`
+	// reloadable
+	SensorsCheckIntervalSeconds int `yaml:"sensorsCheckIntervalSeconds"`
+	// reloadable
+	SensorContainerMapFile        string `yaml:"sensorContainerMapFile"`
+	SensorDriverDockerNetworkName string `yaml:"sensorDriverDockerNetworkName"`
+	// reloadable: debug or info
+	LogLevel string `yaml:"logLevel"`
+	// payload format of the sensor simulator, see the codec package
+	SimulatorFormat string `yaml:"simulatorFormat"`
+	Validation      struct {
+		// zero disables the check
+		MaxFutureSkewSeconds int `yaml:"maxFutureSkewSeconds"`
+		// zero disables the check
+		MaxAgeSeconds int `yaml:"maxAgeSeconds"`
+		// how many rejected messages the admin API keeps
+		RecentRejectionsCount int `yaml:"recentRejectionsCount"`
+		// readings per batch message, zero disables the check
+		MaxBatchSize int `yaml:"maxBatchSize"`
+	} `yaml:"validation"`
+	Topics struct {
+		// placeholders: {sensorId} (required), {quantity}, {hardwareModel}, {sensorType}
+		Template string `yaml:"template"`
+		// renamed topics are still published on under their old name for this long
+		LegacyWindowDays int `yaml:"legacyWindowDays"`
+		// derived topics per topic, like <topic>/in/°F; further ones are denied
+		MaxVariants int `yaml:"maxVariants"`
+		// variants nobody subscribed to for this long are removed; must exceed the broker's ACL cache time
+		VariantIdleMinutes int `yaml:"variantIdleMinutes"`
+	} `yaml:"topics"`
+	Publishing struct {
+		// QoS of the subscription to the incoming topic
+		IncomingQos int `yaml:"incomingQos"`
+		// defaults for outgoing topics
+		Qos    int  `yaml:"qos"`
+		Retain bool `yaml:"retain"`
+		// overrides by quantity and by sensor ID, the latter win
+		Quantities             map[string]PublishPolicyOverride `yaml:"quantities"`
+		Sensors                map[string]PublishPolicyOverride `yaml:"sensors"`
+		Retries                int                              `yaml:"retries"`
+		RetryDelayMilliseconds int                              `yaml:"retryDelayMilliseconds"`
+	} `yaml:"publishing"`
+	Ordering struct {
+		// readings with the sensor ID, quantity and timestamp of an earlier one are dropped, 0 disables
+		DedupWindowSeconds int `yaml:"dedupWindowSeconds"`
+		// for readings older than the newest one of their sensor and quantity: drop, pass or reorder
+		OutOfOrderPolicy string `yaml:"outOfOrderPolicy"`
+		// reorder only: how long readings are held back to be published in timestamp order
+		ReorderDelayMilliseconds int `yaml:"reorderDelayMilliseconds"`
+	} `yaml:"ordering"`
+	Pipeline struct {
+		// the readings of one sensor are always processed by the same worker
+		Workers int `yaml:"workers"`
+		// per worker, in incoming messages
+		QueueSize int `yaml:"queueSize"`
+		// while a worker's queue is full: block, drop-newest or drop-oldest
+		BackpressurePolicy string `yaml:"backpressurePolicy"`
+	} `yaml:"pipeline"`
+	History struct {
+		// defaults to history/ next to the auth DB
+		Directory string `yaml:"directory"`
+		// values older than this are removed, in whole days; 0 keeps them forever
+		RetentionDays int `yaml:"retentionDays"`
+		// overrides by sensor ID
+		SensorRetentionDays map[string]int `yaml:"sensorRetentionDays"`
+	} `yaml:"history"`
+	Aggregation struct {
+		// comma-separated, e.g. 1m,15m,1h; subscribers get aggregates on <topic>/agg/<window>
+		Windows string `yaml:"windows"`
+	} `yaml:"aggregation"`
+	Alerts struct {
+		// rules added through the admin API; defaults to alert-rules.json next to the auth DB
+		RulesFile string `yaml:"rulesFile"`
+		// cannot be changed through the admin API
+		Rules []AlertRule `yaml:"rules"`
+	} `yaml:"alerts"`
+	// computed from the readings of other sensors, see virtual.go
+	VirtualSensors []VirtualSensorDefinition `yaml:"virtualSensors"`
+}
+
+// unset values are taken from the less specific level
+type PublishPolicyOverride struct {
+	Qos    *int  `yaml:"qos"`
+	Retain *bool `yaml:"retain"`
+}
+
+// one setting overridable through env and flags; exactly one of the values is set
+type configSetting struct {
+	flag        string
+	env         string
+	usage       string
+	secret      bool
+	stringValue *string
+	intValue    *int
+	boolValue   *bool
+}
+
+func NewDefaultConfig() Config {
+	config := Config{}
+	config.Mqtt.Host = "sensor-manager-mosquitto"
+	config.Mqtt.Port = 8080
+	config.Http.Port = 8080
+	config.Http.Tls.ReloadIntervalSeconds = 10
+	config.Cimi.Host = "proxy"
+	config.Cimi.Port = 443
+	config.Lifecycle.Host = "lm-um"
+	config.Lifecycle.Port = 46000
+	config.AuthDbFile = "/data/authdb.json"
+	config.SensorAliveTimeoutSeconds = 60
+	config.SensorsCheckIntervalSeconds = 5
+	config.SensorContainerMapFile = "/data/sensor-container-map.json"
+	config.SensorDriverDockerNetworkName = "sensor-manager-network"
+	config.LogLevel = LogLevelInfo
+	config.SimulatorFormat = string(codec.FormatJson)
+	config.Validation.MaxFutureSkewSeconds = 5 * 60
+	config.Validation.MaxAgeSeconds = 30 * 24 * 60 * 60
+	config.Validation.RecentRejectionsCount = 100
+	config.Validation.MaxBatchSize = 1000
+	config.Topics.Template = DefaultTopicTemplate
+	config.Topics.LegacyWindowDays = 90
+	config.Topics.MaxVariants = 16
+	config.Topics.VariantIdleMinutes = 24 * 60
+	config.Publishing.Retries = 3
+	config.Publishing.RetryDelayMilliseconds = 1000
+	config.Ordering.DedupWindowSeconds = 5 * 60
+	config.Ordering.OutOfOrderPolicy = string(OutOfOrderPolicyPass)
+	config.Ordering.ReorderDelayMilliseconds = 2000
+	config.Pipeline.Workers = 4
+	config.Pipeline.QueueSize = 1000
+	config.Pipeline.BackpressurePolicy = string(BackpressurePolicyBlock)
+	config.History.RetentionDays = 30
+	config.Aggregation.Windows = "1m,15m,1h"
+	return config
+}
+
+func (receiver *Config) settings() []configSetting {
+	return []configSetting{
+		{"mqtt-host", "MQTT_HOST", "MQTT broker host", false, &receiver.Mqtt.Host, nil, nil},
+		{"mqtt-port", "MQTT_PORT", "MQTT broker websocket port", false, nil, &receiver.Mqtt.Port, nil},
+		{"mqtt-path-suffix", "MQTT_PATH_SUFFIX", "MQTT broker path suffix passed to sensor drivers", false, &receiver.Mqtt.PathSuffix, nil, nil},
+		{"http-port", "HTTP_PORT", "port of the auth and API server", false, nil, &receiver.Http.Port, nil},
+		{"http-tls-cert-file", "HTTP_TLS_CERT_FILE", "PEM certificate, enables TLS", false, &receiver.Http.Tls.CertFile, nil, nil},
+		{"http-tls-key-file", "HTTP_TLS_KEY_FILE", "PEM key, enables TLS", false, &receiver.Http.Tls.KeyFile, nil, nil},
+		{"http-tls-client-ca-file", "HTTP_TLS_CLIENT_CA_FILE", "PEM CA bundle required for admin API client certificates", false, &receiver.Http.Tls.ClientCaFile, nil, nil},
+		{"http-tls-reload-interval-seconds", "HTTP_TLS_RELOAD_INTERVAL_SECONDS", "how often TLS files are checked for changes", false, nil, &receiver.Http.Tls.ReloadIntervalSeconds, nil},
+		{"http-allowed-origins", "HTTP_ALLOWED_ORIGINS", "comma-separated origins of pages that may open WebSocket streams, besides the server's own", false, &receiver.Http.AllowedOrigins, nil, nil},
+		{"cimi-host", "CIMI_HOST", "CIMI host", false, &receiver.Cimi.Host, nil, nil},
+		{"cimi-port", "CIMI_PORT", "CIMI port", false, nil, &receiver.Cimi.Port, nil},
+		{"lifecycle-host", "LIFECYCLE_HOST", "lifecycle manager host", false, &receiver.Lifecycle.Host, nil, nil},
+		{"lifecycle-port", "LIFECYCLE_PORT", "lifecycle manager port", false, nil, &receiver.Lifecycle.Port, nil},
+		{"administrator-access-token", "ADMINISTRATOR_ACCESS_TOKEN", "password of the system user", true, &receiver.Secrets.AdministratorAccessToken, nil, nil},
+		{"sensor-driver-access-token", "SENSOR_DRIVER_ACCESS_TOKEN", "password of the sensor driver user", true, &receiver.Secrets.SensorDriverAccessToken, nil, nil},
+		{"application-secret", "APPLICATION_SECRET", "seed for generated values", true, &receiver.Secrets.ApplicationSecret, nil, nil},
+		{"auth-db-file", "AUTH_DB_FILE", "auth database file", false, &receiver.AuthDbFile, nil, nil},
+		{"sensor-registry-file", "SENSOR_REGISTRY_FILE", "sensor registry file", false, &receiver.SensorRegistryFile, nil, nil},
+		{"sequences-file", "SEQUENCES_FILE", "file of the topic sequence numbers", false, &receiver.SequencesFile, nil, nil},
+		{"sensor-alive-timeout-seconds", "SENSOR_ALIVE_TIMEOUT_SECONDS", "silence after which a sensor is offline, until its message interval is learned", false, nil, &receiver.SensorAliveTimeoutSeconds, nil},
+		{"sensors-check-interval-seconds", "SENSORS_CHECK_INTERVAL_SECONDS", "how often CIMI is checked for new sensors", false, nil, &receiver.SensorsCheckIntervalSeconds, nil},
+		{"sensor-container-map-file", "SENSOR_CONTAINER_MAP_FILE", "hardware model to driver container mapping", false, &receiver.SensorContainerMapFile, nil, nil},
+		{"sensor-driver-docker-network-name", "SENSOR_DRIVER_DOCKER_NETWORK_NAME", "docker network of the sensor drivers", false, &receiver.SensorDriverDockerNetworkName, nil, nil},
+		{"log-level", "LOG_LEVEL", "debug or info", false, &receiver.LogLevel, nil, nil},
+		{"simulator-format", "SIMULATOR_FORMAT", "payload format of the sensor simulator: json, cbor, protobuf, senml-json or senml-cbor", false, &receiver.SimulatorFormat, nil, nil},
+		{"validation-max-future-skew-seconds", "VALIDATION_MAX_FUTURE_SKEW_SECONDS", "how far reading timestamps may be in the future, 0 disables", false, nil, &receiver.Validation.MaxFutureSkewSeconds, nil},
+		{"validation-max-age-seconds", "VALIDATION_MAX_AGE_SECONDS", "how far reading timestamps may be in the past, 0 disables", false, nil, &receiver.Validation.MaxAgeSeconds, nil},
+		{"validation-recent-rejections-count", "VALIDATION_RECENT_REJECTIONS_COUNT", "how many rejected messages the admin API keeps", false, nil, &receiver.Validation.RecentRejectionsCount, nil},
+		{"validation-max-batch-size", "VALIDATION_MAX_BATCH_SIZE", "readings per batch message, 0 disables", false, nil, &receiver.Validation.MaxBatchSize, nil},
+		{"topic-template", "TOPIC_TEMPLATE", "outgoing topic layout, e.g. /sensor-manager/values/{quantity}/{sensorId}", false, &receiver.Topics.Template, nil, nil},
+		{"topic-legacy-window-days", "TOPIC_LEGACY_WINDOW_DAYS", "how long renamed topics are still published on under their old name", false, nil, &receiver.Topics.LegacyWindowDays, nil},
+		{"topic-max-variants", "TOPIC_MAX_VARIANTS", "derived topics per topic, like <topic>/in/°F", false, nil, &receiver.Topics.MaxVariants, nil},
+		{"topic-variant-idle-minutes", "TOPIC_VARIANT_IDLE_MINUTES", "how long derived topics nobody subscribes to are kept", false, nil, &receiver.Topics.VariantIdleMinutes, nil},
+		{"publish-incoming-qos", "PUBLISH_INCOMING_QOS", "QoS of the subscription to the incoming topic", false, nil, &receiver.Publishing.IncomingQos, nil},
+		{"publish-qos", "PUBLISH_QOS", "default QoS of outgoing topics, see the config file for overrides", false, nil, &receiver.Publishing.Qos, nil},
+		{"publish-retain", "PUBLISH_RETAIN", "whether outgoing topics are retained by default", false, nil, nil, &receiver.Publishing.Retain},
+		{"publish-retries", "PUBLISH_RETRIES", "how often a failed publish is retried", false, nil, &receiver.Publishing.Retries, nil},
+		{"publish-retry-delay-milliseconds", "PUBLISH_RETRY_DELAY_MILLISECONDS", "pause before retrying a failed publish", false, nil, &receiver.Publishing.RetryDelayMilliseconds, nil},
+		{"ordering-dedup-window-seconds", "ORDERING_DEDUP_WINDOW_SECONDS", "how far back duplicate readings are detected, by reading timestamp, 0 disables", false, nil, &receiver.Ordering.DedupWindowSeconds, nil},
+		{"ordering-out-of-order-policy", "ORDERING_OUT_OF_ORDER_POLICY", "what happens to out of order readings: drop, pass or reorder", false, &receiver.Ordering.OutOfOrderPolicy, nil, nil},
+		{"ordering-reorder-delay-milliseconds", "ORDERING_REORDER_DELAY_MILLISECONDS", "how long the reorder policy holds readings back", false, nil, &receiver.Ordering.ReorderDelayMilliseconds, nil},
+		{"pipeline-workers", "PIPELINE_WORKERS", "how many workers process incoming messages", false, nil, &receiver.Pipeline.Workers, nil},
+		{"pipeline-queue-size", "PIPELINE_QUEUE_SIZE", "incoming messages each worker queues", false, nil, &receiver.Pipeline.QueueSize, nil},
+		{"pipeline-backpressure-policy", "PIPELINE_BACKPRESSURE_POLICY", "what happens to incoming messages while a queue is full: block, drop-newest or drop-oldest", false, &receiver.Pipeline.BackpressurePolicy, nil, nil},
+		{"history-directory", "HISTORY_DIRECTORY", "where the value history is stored", false, &receiver.History.Directory, nil, nil},
+		{"history-retention-days", "HISTORY_RETENTION_DAYS", "how long values are kept in the history, 0 keeps them forever", false, nil, &receiver.History.RetentionDays, nil},
+		{"alert-rules-file", "ALERT_RULES_FILE", "file of the alert rules added through the admin API", false, &receiver.Alerts.RulesFile, nil, nil},
+		{"aggregation-windows", "AGGREGATION_WINDOWS", "comma-separated windows of the <topic>/agg/<window> topics, e.g. 1m,15m,1h", false, &receiver.Aggregation.Windows, nil, nil},
+	}
+}
+
+// all overridable settings become string flags, so it can be told apart whether they were set
+func RegisterConfigFlags(flags *flag.FlagSet) {
+	for _, setting := range (&Config{}).settings() {
+		flags.String(setting.flag, "", fmt.Sprintf("%s (env %s)", setting.usage, setting.env))
+	}
+}
+
+func (receiver configSetting) set(source string, value string) error {
+	if receiver.stringValue != nil {
+		*receiver.stringValue = value
+		return nil
+	}
+	if receiver.boolValue != nil {
+		boolValue, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: cannot parse boolean from '%s'", source, value)
+		}
+		*receiver.boolValue = boolValue
+		return nil
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s: cannot parse integer from '%s'", source, value)
+	}
+	*receiver.intValue = intValue
+	return nil
+}
+
+// reports all problems at once; an empty filename skips the file
+func LoadConfig(filename string, flags *flag.FlagSet) (Config, error) {
+	config := NewDefaultConfig()
+	problems := []string{}
+	if filename != "" {
+		// strict, so typos in keys do not go unnoticed
+		if contents, err := ioutil.ReadFile(filename); err != nil {
+			problems = append(problems, fmt.Sprintf("config file %s: %s", filename, err))
+		} else if err := yaml.UnmarshalStrict(contents, &config); err != nil {
+			problems = append(problems, fmt.Sprintf("config file %s: %s", filename, err))
+		}
+	}
+	for _, setting := range config.settings() {
+		if value, exists := os.LookupEnv(setting.env); exists {
+			if err := setting.set("env var "+setting.env, value); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if flags != nil && flags.Changed(setting.flag) {
+			value, _ := flags.GetString(setting.flag)
+			if err := setting.set("flag --"+setting.flag, value); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	if config.SensorRegistryFile == "" {
+		config.SensorRegistryFile = path.Join(path.Dir(config.AuthDbFile), "sensor-registry.json")
+	}
+	if config.SequencesFile == "" {
+		config.SequencesFile = path.Join(path.Dir(config.AuthDbFile), "sequences.json")
+	}
+	if config.History.Directory == "" {
+		config.History.Directory = path.Join(path.Dir(config.AuthDbFile), "history")
+	}
+	if config.Alerts.RulesFile == "" {
+		config.Alerts.RulesFile = path.Join(path.Dir(config.AuthDbFile), "alert-rules.json")
+	}
+	if len(problems) > 0 {
+		return config, fmt.Errorf("invalid configuration:\n    %s", strings.Join(problems, "\n    "))
+	}
+	return config, nil
+}
+
+// simulation only needs to reach the broker, production needs everything
+func (receiver Config) Validate(production bool) error {
+	problems := []string{}
+	requireString := func(name string, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s must be set", name))
+		}
+	}
+	requirePort := func(name string, value int) {
+		if value < 1 || value > 65535 {
+			problems = append(problems, fmt.Sprintf("%s must be between 1 and 65535, is %d", name, value))
+		}
+	}
+	requirePositive := func(name string, value int) {
+		if value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive, is %d", name, value))
+		}
+	}
+	requireNonNegative := func(name string, value int) {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative, is %d", name, value))
+		}
+	}
+
+	requireString("mqtt host", receiver.Mqtt.Host)
+	requirePort("mqtt port", receiver.Mqtt.Port)
+	requireString("sensor driver access token", receiver.Secrets.SensorDriverAccessToken)
+	if !isValidLogLevel(receiver.LogLevel) {
+		problems = append(problems, fmt.Sprintf("log level must be %s or %s, is '%s'", LogLevelDebug, LogLevelInfo, receiver.LogLevel))
+	}
+	if _, err := codec.ParseFormat(receiver.SimulatorFormat); err != nil {
+		problems = append(problems, fmt.Sprintf("simulator format: %s", err))
+	}
+
+	if production {
+		requirePort("http port", receiver.Http.Port)
+		requirePort("cimi port", receiver.Cimi.Port)
+		requirePort("lifecycle port", receiver.Lifecycle.Port)
+		requireString("cimi host", receiver.Cimi.Host)
+		requireString("lifecycle host", receiver.Lifecycle.Host)
+		requireString("administrator access token", receiver.Secrets.AdministratorAccessToken)
+		requireString("application secret", receiver.Secrets.ApplicationSecret)
+		requireString("auth DB file", receiver.AuthDbFile)
+		requireString("sensor driver docker network name", receiver.SensorDriverDockerNetworkName)
+		requirePositive("sensors check interval", receiver.SensorsCheckIntervalSeconds)
+		requirePositive("sensor alive timeout", receiver.SensorAliveTimeoutSeconds)
+		requireNonNegative("validation max future skew", receiver.Validation.MaxFutureSkewSeconds)
+		requireNonNegative("validation max age", receiver.Validation.MaxAgeSeconds)
+		requireNonNegative("recent rejections count", receiver.Validation.RecentRejectionsCount)
+		requireNonNegative("validation max batch size", receiver.Validation.MaxBatchSize)
+		requireNonNegative("topic legacy window", receiver.Topics.LegacyWindowDays)
+		requireNonNegative("topic max variants", receiver.Topics.MaxVariants)
+		requirePositive("topic variant idle time", receiver.Topics.VariantIdleMinutes)
+		if err := validateTopicTemplate(receiver.Topics.Template); err != nil {
+			problems = append(problems, err.Error())
+		}
+		requireQos := func(name string, value *int) {
+			if value != nil && (*value < 0 || *value > 2) {
+				problems = append(problems, fmt.Sprintf("%s must be 0, 1 or 2, is %d", name, *value))
+			}
+		}
+		requireQos("incoming QoS", &receiver.Publishing.IncomingQos)
+		requireQos("publish QoS", &receiver.Publishing.Qos)
+		for quantity, override := range receiver.Publishing.Quantities {
+			if _, ok := lookupQuantity(quantity); !ok {
+				problems = append(problems, fmt.Sprintf("publishing override for unknown quantity %s", quantity))
+			}
+			requireQos(fmt.Sprintf("publish QoS of quantity %s", quantity), override.Qos)
+		}
+		for sensorId, override := range receiver.Publishing.Sensors {
+			requireQos(fmt.Sprintf("publish QoS of sensor %s", sensorId), override.Qos)
+		}
+		requireNonNegative("publish retries", receiver.Publishing.Retries)
+		requireNonNegative("publish retry delay", receiver.Publishing.RetryDelayMilliseconds)
+		requireNonNegative("dedup window", receiver.Ordering.DedupWindowSeconds)
+		if _, err := parseOutOfOrderPolicy(receiver.Ordering.OutOfOrderPolicy); err != nil {
+			problems = append(problems, err.Error())
+		}
+		requireNonNegative("reorder delay", receiver.Ordering.ReorderDelayMilliseconds)
+		requirePositive("pipeline workers", receiver.Pipeline.Workers)
+		requirePositive("pipeline queue size", receiver.Pipeline.QueueSize)
+		if _, err := parseBackpressurePolicy(receiver.Pipeline.BackpressurePolicy); err != nil {
+			problems = append(problems, err.Error())
+		}
+		requireNonNegative("history retention", receiver.History.RetentionDays)
+		for sensorId, days := range receiver.History.SensorRetentionDays {
+			requireNonNegative(fmt.Sprintf("history retention of sensor %s", sensorId), days)
+		}
+		if _, err := parseAggregateWindows(receiver.Aggregation.Windows); err != nil {
+			problems = append(problems, err.Error())
+		}
+		ruleIds := map[string]bool{}
+		for _, rule := range receiver.Alerts.Rules {
+			if _, err := rule.normalized(); err != nil {
+				problems = append(problems, err.Error())
+			}
+			if ruleIds[rule.Id] {
+				problems = append(problems, fmt.Sprintf("alert rule ID %s is used more than once", rule.Id))
+			}
+			ruleIds[rule.Id] = true
+		}
+		problems = append(problems, validateVirtualSensors(receiver.VirtualSensors)...)
+		if _, err := os.Stat(receiver.SensorContainerMapFile); err != nil {
+			problems = append(problems, fmt.Sprintf("sensor container map file: %s", err))
+		}
+
+		tls := receiver.HttpTlsParameters()
+		if (tls.CertFile == "") != (tls.KeyFile == "") {
+			problems = append(problems, "TLS certificate and key file must be set together")
+		}
+		if tls.clientCertificatesRequired() && !tls.enabled() {
+			problems = append(problems, "a TLS client CA file needs the TLS certificate and key file")
+		}
+		if tls.enabled() {
+			requirePositive("TLS reload interval", receiver.Http.Tls.ReloadIntervalSeconds)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n    %s", strings.Join(problems, "\n    "))
+	}
+	return nil
+}
+
+func (receiver Config) HttpTlsParameters() HttpServerTlsParameters {
+	return HttpServerTlsParameters{
+		CertFile:       receiver.Http.Tls.CertFile,
+		KeyFile:        receiver.Http.Tls.KeyFile,
+		ClientCaFile:   receiver.Http.Tls.ClientCaFile,
+		ReloadInterval: time.Duration(receiver.Http.Tls.ReloadIntervalSeconds) * time.Second,
+	}
+}
+
+func (receiver Config) HttpAllowedOrigins() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(receiver.Http.AllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+func (receiver Config) ValidationLimits() ValidationLimits {
+	return ValidationLimits{
+		MaxFutureSkew: time.Duration(receiver.Validation.MaxFutureSkewSeconds) * time.Second,
+		MaxAge:        time.Duration(receiver.Validation.MaxAgeSeconds) * time.Second,
+		MaxBatchSize:  receiver.Validation.MaxBatchSize,
+	}
+}
+
+func (receiver Config) TopicLayout() TopicLayout {
+	// validated beforehand
+	aggregateWindows, _ := parseAggregateWindows(receiver.Aggregation.Windows)
+	return TopicLayout{
+		Template:           receiver.Topics.Template,
+		LegacyWindow:       time.Duration(receiver.Topics.LegacyWindowDays) * 24 * time.Hour,
+		AggregateWindows:   aggregateWindows,
+		MaxVariants:        receiver.Topics.MaxVariants,
+		VariantIdleTimeout: time.Duration(receiver.Topics.VariantIdleMinutes) * time.Minute,
+	}
+}
+
+func (receiver Config) PublishSettings() PublishSettings {
+	settings := PublishSettings{
+		IncomingQos: byte(receiver.Publishing.IncomingQos),
+		Default:     PublishPolicy{Qos: byte(receiver.Publishing.Qos), Retain: receiver.Publishing.Retain},
+		Quantities:  map[string]PublishPolicyOverride{},
+		Sensors:     receiver.Publishing.Sensors,
+		Retries:     receiver.Publishing.Retries,
+		RetryDelay:  time.Duration(receiver.Publishing.RetryDelayMilliseconds) * time.Millisecond,
+	}
+	// readings are looked up by their normalized quantity
+	for name, override := range receiver.Publishing.Quantities {
+		if quantity, ok := lookupQuantity(name); ok {
+			settings.Quantities[quantity.Name] = override
+		}
+	}
+	return settings
+}
+
+func (receiver Config) OrderingSettings() OrderingSettings {
+	return OrderingSettings{
+		DedupWindow:  time.Duration(receiver.Ordering.DedupWindowSeconds) * time.Second,
+		OutOfOrder:   OutOfOrderPolicy(receiver.Ordering.OutOfOrderPolicy),
+		ReorderDelay: time.Duration(receiver.Ordering.ReorderDelayMilliseconds) * time.Millisecond,
+	}
+}
+
+func (receiver Config) PipelineSettings() PipelineSettings {
+	return PipelineSettings{
+		Workers:      receiver.Pipeline.Workers,
+		QueueSize:    receiver.Pipeline.QueueSize,
+		Backpressure: BackpressurePolicy(receiver.Pipeline.BackpressurePolicy),
+	}
+}
+
+func (receiver Config) HistorySettings() HistorySettings {
+	settings := HistorySettings{
+		Directory:       receiver.History.Directory,
+		Retention:       time.Duration(receiver.History.RetentionDays) * 24 * time.Hour,
+		SensorRetention: map[string]time.Duration{},
+	}
+	for sensorId, days := range receiver.History.SensorRetentionDays {
+		settings.SensorRetention[sensorId] = time.Duration(days) * 24 * time.Hour
+	}
+	return settings
+}
+
+func (receiver Config) LogEffectiveValues() {
+	for _, setting := range receiver.settings() {
+		var value string
+		if setting.stringValue != nil {
+			value = *setting.stringValue
+		} else if setting.boolValue != nil {
+			value = strconv.FormatBool(*setting.boolValue)
+		} else {
+			value = strconv.Itoa(*setting.intValue)
+		}
+		if setting.secret && value != "" {
+			value = "<redacted>"
+		}
+		log.Printf("Config %s = %s", setting.flag, value)
+	}
+}
+
+// the settings that can change without a restart
+type RuntimeSettings struct {
+	lock                       sync.RWMutex
+	sensorsCheckInterval       time.Duration
+	sensorContainerMapFilename string
+}
+
+func NewRuntimeSettings(config Config) *RuntimeSettings {
+	settings := &RuntimeSettings{}
+	settings.apply(config)
+	return settings
+}
+
+func (receiver *RuntimeSettings) apply(config Config) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	receiver.sensorsCheckInterval = time.Duration(config.SensorsCheckIntervalSeconds) * time.Second
+	receiver.sensorContainerMapFilename = config.SensorContainerMapFile
+	// validated beforehand
+	_ = setLogLevel(config.LogLevel)
+}
+
+func (receiver *RuntimeSettings) getSensorsCheckInterval() time.Duration {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	return receiver.sensorsCheckInterval
+}
+
+func (receiver *RuntimeSettings) getSensorContainerMapFilename() string {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	return receiver.sensorContainerMapFilename
+}
+
+// an invalid new config is logged and ignored; changes to other settings need a restart
+func ReloadConfigOnSighup(filename string, flags *flag.FlagSet, current Config, runtimeSettings *RuntimeSettings) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Printf("Got SIGHUP, reloading the configuration.")
+		reloaded, err := LoadConfig(filename, flags)
+		if err == nil {
+			err = reloaded.Validate(true)
+		}
+		if err != nil {
+			log.Printf("Keeping the old configuration: %s", err)
+			continue
+		}
+
+		withoutReloadable := reloaded
+		withoutReloadable.SensorsCheckIntervalSeconds = current.SensorsCheckIntervalSeconds
+		withoutReloadable.SensorContainerMapFile = current.SensorContainerMapFile
+		withoutReloadable.LogLevel = current.LogLevel
+		if !reflect.DeepEqual(withoutReloadable, current) {
+			log.Printf("Only the check interval, container map file and log level are reloaded, other changes need a restart.")
+		}
+		runtimeSettings.apply(reloaded)
+		// the rest still runs with the values the process started with, so later reloads keep warning about them
+		current.SensorsCheckIntervalSeconds = reloaded.SensorsCheckIntervalSeconds
+		current.SensorContainerMapFile = reloaded.SensorContainerMapFile
+		current.LogLevel = reloaded.LogLevel
+		log.Printf("Configuration reloaded: check interval %ds, container map file %s, log level %s.",
+			reloaded.SensorsCheckIntervalSeconds, reloaded.SensorContainerMapFile, reloaded.LogLevel)
+	}
+}
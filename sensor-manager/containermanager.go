@@ -64,6 +64,7 @@ func getDriverContainerForSensor(sensorContainerMapFilename string, sensor CimiS
 		{"SENSOR_MANAGER_PASSWORD", authDb.SensorDriverAccessToken},
 		{"SENSOR_MANAGER_TOPIC", TopicSensorReceive},
 		{"SENSOR_CONNECTION_INFO", string(connectionParamsJson)},
+		{"SENSOR_HARDWARE_MODEL", sensor.HardwareModel},
 	}
 
 	return &SensorDriverContainer{
@@ -164,7 +165,7 @@ func getOrCreateServiceInstance(cimiConnectionParams Mf2cConnectionParameters, l
 }
 
 func StartContainerManager(wg *sync.WaitGroup, cimiTraefikHost string, cimiTraefikPort uint16, lifecycleHost string, lifecyclePort uint16,
-	mqttHost string, mqttPort uint16, authDb *AuthDatabase, sensorCheckIntervalSeconds uint, sensorContainerMapFilename string, sensorDriverDockerNetworkName string, mqttPathSuffix string) {
+	mqttHost string, mqttPort uint16, authDb *AuthDatabase, runtimeSettings *RuntimeSettings, sensorDriverDockerNetworkName string, mqttPathSuffix string) {
 	defer wg.Done()
 	log.Println("Starting container manager.")
 
@@ -216,7 +217,7 @@ func StartContainerManager(wg *sync.WaitGroup, cimiTraefikHost string, cimiTraef
 		sensors, err := getSensorsFromCimi(cimiConnectionParams)
 		if err != nil {
 			log.Printf("Error getting sensors from CIMI: %s", err)
-			time.Sleep(time.Duration(sensorCheckIntervalSeconds) * time.Second)
+			time.Sleep(runtimeSettings.getSensorsCheckInterval())
 			continue
 		}
 
@@ -226,7 +227,7 @@ func StartContainerManager(wg *sync.WaitGroup, cimiTraefikHost string, cimiTraef
 			if !present {
 				knownSensors[s.HardwareModel] = s
 				log.Printf("Adding a new sensor container: %s", s.HardwareModel)
-				sensorDriverContainer, err := getDriverContainerForSensor(sensorContainerMapFilename, s, authDb, mqttHost, mqttPort, sensorDriverDockerNetworkName, mqttPathSuffix)
+				sensorDriverContainer, err := getDriverContainerForSensor(runtimeSettings.getSensorContainerMapFilename(), s, authDb, mqttHost, mqttPort, sensorDriverDockerNetworkName, mqttPathSuffix)
 				if err != nil {
 					log.Printf("Error adding a new sensor container: %s", err)
 					break
@@ -246,6 +247,6 @@ func StartContainerManager(wg *sync.WaitGroup, cimiTraefikHost string, cimiTraef
 			}
 		}
 
-		time.Sleep(time.Duration(sensorCheckIntervalSeconds) * time.Second)
+		time.Sleep(runtimeSettings.getSensorsCheckInterval())
 	}
 }
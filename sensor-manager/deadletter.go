@@ -0,0 +1,98 @@
+package sensormanager
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// rejected messages go here, only the superuser may read it
+const TopicDeadLetter = "/sensor-manager/dead-letter"
+
+// a rejected message with the reason, so driver authors can see why their data disappears
+type DeadLetter struct {
+	ReceivedAt    string
+	OriginalTopic string
+	Driver        string
+	Reason        RejectionReason
+	Detail        string
+	// the payload as received if it is text, otherwise base64 encoded in PayloadBase64
+	Payload       string `json:",omitempty"`
+	PayloadBase64 string `json:",omitempty"`
+}
+
+// keeps the most recent dead letters for the admin API
+type DeadLetterLog struct {
+	lock     sync.Mutex
+	entries  []DeadLetter
+	next     int
+	capacity int
+}
+
+func NewDeadLetterLog(capacity int) *DeadLetterLog {
+	return &DeadLetterLog{
+		entries:  make([]DeadLetter, 0, capacity),
+		capacity: capacity,
+	}
+}
+
+func newDeadLetter(originalTopic string, payload []byte, driver string, rejection *MessageRejection) DeadLetter {
+	letter := DeadLetter{
+		ReceivedAt:    time.Now().Format(time.RFC3339Nano),
+		OriginalTopic: originalTopic,
+		Driver:        driver,
+		Reason:        rejection.Reason,
+		Detail:        rejection.Detail,
+	}
+	if utf8.Valid(payload) {
+		letter.Payload = string(payload)
+	} else {
+		letter.PayloadBase64 = base64.StdEncoding.EncodeToString(payload)
+	}
+	return letter
+}
+
+func (receiver *DeadLetterLog) add(letter DeadLetter) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if receiver.capacity <= 0 {
+		return
+	}
+	if len(receiver.entries) < receiver.capacity {
+		receiver.entries = append(receiver.entries, letter)
+	} else {
+		receiver.entries[receiver.next] = letter
+	}
+	receiver.next = (receiver.next + 1) % receiver.capacity
+}
+
+// newest first, at most limit entries (all if limit is not positive)
+func (receiver *DeadLetterLog) recent(limit int) []DeadLetter {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	count := len(receiver.entries)
+	if limit > 0 && limit < count {
+		count = limit
+	}
+	result := make([]DeadLetter, 0, count)
+	for i := 1; i <= count; i++ {
+		index := (receiver.next - i + len(receiver.entries)) % len(receiver.entries)
+		result = append(result, receiver.entries[index])
+	}
+	return result
+}
+
+// does not wait for the publish, as this runs inside the MQTT callback
+func publishDeadLetter(client mqtt.Client, deadLetters *DeadLetterLog, letter DeadLetter) {
+	deadLetters.add(letter)
+	marshaled, err := json.Marshal(letter)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client.Publish(TopicDeadLetter, 0, false, marshaled)
+}
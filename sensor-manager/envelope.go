@@ -0,0 +1,56 @@
+package sensormanager
+
+import (
+	"mf2c-sensor-manager/codec"
+	"sync"
+	"time"
+)
+
+// subscribers of <topic>/v2 get the values with their provenance, see codec.Provenance;
+// combines with the other variants, except aggregates and SenML, which have no place for it
+const TopicVariantEnvelope = "v2"
+const EnvelopeVersion = 2
+
+// quality flags of v2 envelopes
+const (
+	// corrected by the sensor's calibration, see calibration.go
+	QualityCalibrated = "calibrated"
+	// the value of a virtual sensor, see virtual.go
+	QualityComputed = "computed"
+	// older than a value published on the topic before
+	QualityOutOfOrder = "out-of-order"
+)
+
+// notes what happened to the values of each topic; their sequence numbers are on every topic, see TopicSequences
+type provenanceStamper struct {
+	lock sync.Mutex
+	// the newest timestamp published, per sensor and quantity
+	newest map[string]time.Time
+}
+
+func newProvenanceStamper() *provenanceStamper {
+	return &provenanceStamper{newest: map[string]time.Time{}}
+}
+
+// every value is stamped, whether a v2 variant of its topic is subscribed or not, so all subscribers see the same flags
+func (receiver *provenanceStamper) stamp(topic SensorTopic, reading IncomingSensorMessage, receivedAt time.Time, quality []string) *codec.Provenance {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	key := buildSensorTopicKey(topic.SensorId, topic.Quantity)
+	// validated beforehand
+	measuredAt, _ := time.Parse(time.RFC3339Nano, reading.Timestamp)
+	if measuredAt.Before(receiver.newest[key]) {
+		quality = append(quality, QualityOutOfOrder)
+	} else {
+		receiver.newest[key] = measuredAt
+	}
+	return &codec.Provenance{
+		Version:       EnvelopeVersion,
+		SensorId:      reading.SensorId,
+		SensorType:    reading.SensorType,
+		Quantity:      reading.Quantity,
+		HardwareModel: reading.HardwareModel,
+		ReceivedAt:    receivedAt.UTC().Format(time.RFC3339Nano),
+		Quality:       quality,
+	}
+}
@@ -0,0 +1,535 @@
+package sensormanager
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replays are published on <topic>/replay/<random ID>, readable only by the user who requested them
+const TopicSuffixReplay = "replay"
+
+// values are kept per sensor, quantity and UTC day, as 8 bytes Unix nanoseconds and 8 bytes value, little endian
+const historyRecordSize = 16
+const historyDayLayout = "2006-01-02"
+const historyFileSuffix = ".bin"
+
+// next to a day file whose records are not in timestamp order, which is then read whole instead of searched
+const historyUnsortedSuffix = ".unsorted"
+
+// time for the client to subscribe to the replay topic before publishing starts, from when the replay was queued
+const ReplayStartDelay = 5 * time.Second
+
+// queries and replays returning more values are rejected, queries can set a step instead
+const HistoryQueryMaxPoints = 10000
+
+// longer ranges are rejected before reading anything
+const HistoryQueryMaxRange = 31 * 24 * time.Hour
+
+const HistoryPruneInterval = 1 * time.Hour
+
+// day files without appends for this long are closed, checked when pruning
+const HistoryWriterIdleTimeout = 1 * time.Hour
+
+type HistorySettings struct {
+	Directory string
+	// zero keeps values forever
+	Retention time.Duration
+	// overrides by sensor ID
+	SensorRetention map[string]time.Duration
+}
+
+type HistoryResponse struct {
+	SensorId string `json:"sensorId"`
+	Quantity string `json:"quantity"`
+	// with a step, each value is the mean of the values from its timestamp on for one step
+	Values []OutgoingClientMessage `json:"values"`
+}
+
+type ReplayResponse struct {
+	Topic string `json:"topic"`
+	// publishing starts no earlier, later if other replays are still running
+	StartsAt time.Time `json:"startsAt"`
+	Count    int       `json:"count"`
+	SensorId string    `json:"sensorId"`
+	Quantity string    `json:"quantity"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+}
+
+type historyPoint struct {
+	measuredAt time.Time
+	value      float64
+}
+
+type replayJob struct {
+	topic string
+	// the only user allowed to read the topic, see AuthDatabase.isAuthorized
+	username string
+	points   []historyPoint
+	unit     string
+	startsAt time.Time
+}
+
+// keeps one day file open for appending, so the workers of different sensors do not wait for each other
+type historyWriter struct {
+	lock      sync.Mutex
+	file      *os.File
+	lastWrite time.Time
+	// closed and no longer in the store, appends must get a new writer
+	retired bool
+	// the newest timestamp in the file, and whether an older one was appended after it
+	newest   time.Time
+	unsorted bool
+}
+
+// fed by the transformation pipeline with normalized readings; files are only appended to, so values are sorted on read
+// if they arrived out of order, see historyUnsortedSuffix
+type HistoryStore struct {
+	settings HistorySettings
+	// guards the writers only, files are never read or written with it held
+	lock sync.Mutex
+	// by filename
+	writers map[string]*historyWriter
+	replays chan replayJob
+}
+
+func NewHistoryStore(settings HistorySettings) *HistoryStore {
+	if err := os.MkdirAll(settings.Directory, 0776); err != nil {
+		log.Println(fmt.Errorf("could not create the history directory, panic"))
+		panic(err)
+	}
+	return &HistoryStore{settings: settings, writers: map[string]*historyWriter{}, replays: make(chan replayJob, 16)}
+}
+
+// sensor IDs get a prefix, so encoded IDs like .. stay inside the directory
+func (receiver *HistoryStore) sensorDirectory(sensorId string) string {
+	return path.Join(receiver.settings.Directory, "sensor-"+encodeTopicLevel(sensorId))
+}
+
+func (receiver *HistoryStore) quantityDirectory(sensorId string, quantity string) string {
+	return path.Join(receiver.sensorDirectory(sensorId), encodeTopicLevel(quantity))
+}
+
+func (receiver *HistoryStore) append(reading IncomingSensorMessage) {
+	measuredAt, err := time.Parse(time.RFC3339Nano, reading.Timestamp)
+	if err != nil {
+		return
+	}
+	record := encodeHistoryRecord(measuredAt, reading.Value)
+	directory := receiver.quantityDirectory(reading.SensorId, reading.Quantity)
+	filename := path.Join(directory, measuredAt.UTC().Format(historyDayLayout)+historyFileSuffix)
+
+	for {
+		writer := receiver.writerFor(filename)
+		writer.lock.Lock()
+		if writer.retired {
+			writer.lock.Unlock()
+			continue
+		}
+		if err := writer.write(directory, filename, record, measuredAt); err != nil {
+			log.Println(err)
+		}
+		writer.lock.Unlock()
+		return
+	}
+}
+
+func (receiver *HistoryStore) writerFor(filename string) *historyWriter {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	writer, ok := receiver.writers[filename]
+	if !ok {
+		writer = &historyWriter{}
+		receiver.writers[filename] = writer
+	}
+	return writer
+}
+
+func encodeHistoryRecord(measuredAt time.Time, value float64) []byte {
+	record := make([]byte, historyRecordSize)
+	binary.LittleEndian.PutUint64(record[0:8], uint64(measuredAt.UnixNano()))
+	binary.LittleEndian.PutUint64(record[8:16], math.Float64bits(value))
+	return record
+}
+
+func decodeHistoryRecord(record []byte) (time.Time, float64) {
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(record[0:8]))), math.Float64frombits(binary.LittleEndian.Uint64(record[8:16]))
+}
+
+// must be called with the writer's lock held
+func (receiver *historyWriter) open(directory string, filename string) error {
+	if err := os.MkdirAll(directory, 0776); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	// a torn last record from a crash is cut off, so the records appended stay aligned
+	count := info.Size() / historyRecordSize
+	if info.Size() != count*historyRecordSize {
+		if err := file.Truncate(count * historyRecordSize); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	receiver.newest, receiver.unsorted = time.Time{}, false
+	if count > 0 {
+		last := make([]byte, historyRecordSize)
+		if _, err := file.ReadAt(last, (count-1)*historyRecordSize); err != nil {
+			_ = file.Close()
+			return err
+		}
+		receiver.newest, _ = decodeHistoryRecord(last)
+	}
+	if _, err := os.Stat(filename + historyUnsortedSuffix); err == nil {
+		receiver.unsorted = true
+	}
+	receiver.file = file
+	return nil
+}
+
+// must be called with the writer's lock held
+func (receiver *historyWriter) write(directory string, filename string, record []byte, measuredAt time.Time) error {
+	if receiver.file == nil {
+		if err := receiver.open(directory, filename); err != nil {
+			return err
+		}
+	}
+	// before the record is written, so no query searches the file in the meantime
+	if measuredAt.Before(receiver.newest) && !receiver.unsorted {
+		if err := ioutil.WriteFile(filename+historyUnsortedSuffix, nil, 0660); err != nil {
+			return err
+		}
+		receiver.unsorted = true
+	}
+	if measuredAt.After(receiver.newest) {
+		receiver.newest = measuredAt
+	}
+	receiver.lastWrite = time.Now()
+	_, err := receiver.file.Write(record)
+	return err
+}
+
+// must be called with the store's and the writer's lock held
+func (receiver *HistoryStore) retireWriterLocked(filename string, writer *historyWriter) {
+	if writer.file != nil {
+		if err := writer.file.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	writer.file = nil
+	writer.retired = true
+	delete(receiver.writers, filename)
+}
+
+// days of the past stay open until they have been idle for a while, as values may arrive late
+func (receiver *HistoryStore) closeIdleWriters(now time.Time) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	for filename, writer := range receiver.writers {
+		writer.lock.Lock()
+		if now.Sub(writer.lastWrite) > HistoryWriterIdleTimeout {
+			receiver.retireWriterLocked(filename, writer)
+		}
+		writer.lock.Unlock()
+	}
+}
+
+// the store's lock is held while removing, so an append cannot reopen the file in between
+func (receiver *HistoryStore) removeDayFile(filename string) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if writer, ok := receiver.writers[filename]; ok {
+		writer.lock.Lock()
+		receiver.retireWriterLocked(filename, writer)
+		writer.lock.Unlock()
+	}
+	if err := os.Remove(filename); err != nil {
+		log.Println(err)
+	}
+	if err := os.Remove(filename + historyUnsortedSuffix); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+// visits the records of one day file from from on, until visit returns false; sorted files are searched for from and
+// read until to, others are read whole; a record being appended is ignored as torn
+func readHistoryFile(filename string, from time.Time, to time.Time, visit func(measuredAt time.Time, value float64) bool) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	count := info.Size() / historyRecordSize
+	_, err = os.Stat(filename + historyUnsortedSuffix)
+	sorted := os.IsNotExist(err)
+	record := make([]byte, historyRecordSize)
+
+	start := int64(0)
+	if sorted {
+		var searchErr error
+		start = int64(sort.Search(int(count), func(i int) bool {
+			if _, err := file.ReadAt(record, int64(i)*historyRecordSize); err != nil {
+				searchErr = err
+				return true
+			}
+			measuredAt, _ := decodeHistoryRecord(record)
+			return !measuredAt.Before(from)
+		}))
+		if searchErr != nil {
+			return searchErr
+		}
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start*historyRecordSize, (count-start)*historyRecordSize))
+	for i := start; i < count; i++ {
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return err
+		}
+		measuredAt, value := decodeHistoryRecord(record)
+		if !measuredAt.Before(to) {
+			if sorted {
+				return nil
+			}
+			continue
+		}
+		if measuredAt.Before(from) {
+			continue
+		}
+		if !visit(measuredAt, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// from inclusive, to exclusive, sorted by timestamp; reads without any lock, see readHistoryFile.
+// With a step, each point is the mean of the values from its timestamp on for one step, starting at from; the caller
+// limits the number of steps, and so the sums kept. Without one, reading stops as incomplete after HistoryQueryMaxPoints values.
+func (receiver *HistoryStore) query(sensorId string, quantity string, from time.Time, to time.Time, step time.Duration) (points []historyPoint, complete bool, err error) {
+	directory := receiver.quantityDirectory(sensorId, quantity)
+	points = []historyPoint{}
+	sums := map[time.Time]float64{}
+	counts := map[time.Time]int{}
+	limitReached := false
+	visit := func(measuredAt time.Time, value float64) bool {
+		if step > 0 {
+			bucket := from.Add(measuredAt.Sub(from) / step * step)
+			sums[bucket] += value
+			counts[bucket]++
+			return true
+		}
+		if len(points) == HistoryQueryMaxPoints {
+			limitReached = true
+			return false
+		}
+		points = append(points, historyPoint{measuredAt, value})
+		return true
+	}
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		if err := readHistoryFile(path.Join(directory, day.Format(historyDayLayout)+historyFileSuffix), from, to, visit); err != nil {
+			return nil, false, err
+		}
+		if limitReached {
+			return nil, false, nil
+		}
+	}
+	for bucket, sum := range sums {
+		points = append(points, historyPoint{bucket, sum / float64(counts[bucket])})
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].measuredAt.Before(points[j].measuredAt)
+	})
+	return points, true, nil
+}
+
+func toOutgoingMessages(points []historyPoint, unit string) []OutgoingClientMessage {
+	messages := []OutgoingClientMessage{}
+	for _, point := range points {
+		messages = append(messages, OutgoingClientMessage{
+			Timestamp: point.measuredAt.UTC().Format(time.RFC3339Nano),
+			Value:     point.value,
+			Unit:      unit,
+		})
+	}
+	return messages
+}
+
+func (receiver *HistoryStore) retentionFor(sensorId string) time.Duration {
+	if retention, ok := receiver.settings.SensorRetention[sensorId]; ok {
+		return retention
+	}
+	return receiver.settings.Retention
+}
+
+// whole days are removed once all of their values are older than the sensor's retention
+func (receiver *HistoryStore) prune(now time.Time, sensorIds []string) {
+	for _, sensorId := range sensorIds {
+		retention := receiver.retentionFor(sensorId)
+		if retention <= 0 {
+			continue
+		}
+		quantityDirectories, err := ioutil.ReadDir(receiver.sensorDirectory(sensorId))
+		if err != nil {
+			continue
+		}
+		for _, quantityDirectory := range quantityDirectories {
+			directory := path.Join(receiver.sensorDirectory(sensorId), quantityDirectory.Name())
+			files, err := ioutil.ReadDir(directory)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			for _, file := range files {
+				day, err := time.Parse(historyDayLayout, strings.TrimSuffix(file.Name(), historyFileSuffix))
+				if err != nil || !day.Add(24*time.Hour).Before(now.Add(-retention)) {
+					continue
+				}
+				receiver.removeDayFile(path.Join(directory, file.Name()))
+			}
+		}
+	}
+}
+
+// only sensors the auth database knows are pruned
+func (receiver *HistoryStore) PruneHistoryPeriodically(authDb *AuthDatabase) {
+	for now := range time.Tick(HistoryPruneInterval) {
+		sensorIds := map[string]bool{}
+		for _, topic := range authDb.copyTopics() {
+			sensorIds[topic.SensorId] = true
+		}
+		ids := []string{}
+		for sensorId := range sensorIds {
+			ids = append(ids, sensorId)
+		}
+		receiver.prune(now, ids)
+		receiver.closeIdleWriters(now)
+	}
+}
+
+// replays are queued until the MQTT client is connected, see RunReplays
+func (receiver *HistoryStore) queueReplay(authDb *AuthDatabase, topic SensorTopic, username string, from time.Time, to time.Time) (response ReplayResponse, status int, err error) {
+	points, complete, err := receiver.query(topic.SensorId, topic.Quantity, from, to, 0)
+	if err != nil {
+		return ReplayResponse{}, 500, err
+	}
+	if !complete {
+		return ReplayResponse{}, 400, fmt.Errorf("more than %d values in the range, narrow the range", HistoryQueryMaxPoints)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ReplayResponse{}, 500, err
+	}
+	unit := ""
+	if quantity, ok := lookupQuantity(topic.Quantity); ok {
+		unit = quantity.CanonicalUnit
+	}
+	job := replayJob{
+		topic:    topic.Name + "/" + TopicSuffixReplay + "/" + hex.EncodeToString(id),
+		username: username,
+		points:   points,
+		unit:     unit,
+		startsAt: time.Now().Add(ReplayStartDelay),
+	}
+	authDb.grantReplay(job.topic, job.username)
+	select {
+	case receiver.replays <- job:
+	default:
+		authDb.revokeReplay(job.topic)
+		return ReplayResponse{}, 503, fmt.Errorf("too many replays are waiting, try again later")
+	}
+	return ReplayResponse{
+		Topic:    job.topic,
+		StartsAt: job.startsAt,
+		Count:    len(points),
+		SensorId: topic.SensorId,
+		Quantity: topic.Quantity,
+		From:     from,
+		To:       to,
+	}, 200, nil
+}
+
+// one replay at a time, in timestamp order
+func (receiver *HistoryStore) RunReplays(client mqtt.Client, authDb *AuthDatabase) {
+	for job := range receiver.replays {
+		time.Sleep(time.Until(job.startsAt))
+		log.Printf("Replaying %d values on %s.", len(job.points), job.topic)
+		for _, message := range toOutgoingMessages(job.points, job.unit) {
+			marshaled, err := json.Marshal(message)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			token := client.Publish(job.topic, 1, false, marshaled)
+			if !token.WaitTimeout(PublishTimeout) || token.Error() != nil {
+				log.Printf("Replay on %s aborted: %v", job.topic, token.Error())
+				break
+			}
+		}
+		// the broker may still be delivering the last values
+		topic := job.topic
+		time.AfterFunc(ReplayStartDelay, func() {
+			authDb.revokeReplay(topic)
+		})
+	}
+}
+
+// from and to are RFC 3339, the last hour by default; step is a duration like 5m
+func parseHistoryRange(request *http.Request) (from time.Time, to time.Time, step time.Duration, err error) {
+	query := request.URL.Query()
+	to = time.Now()
+	if toString := query.Get("to"); toString != "" {
+		if to, err = time.Parse(time.RFC3339Nano, toString); err != nil {
+			return from, to, step, fmt.Errorf("cannot parse to '%s' as an RFC 3339 timestamp", toString)
+		}
+	}
+	from = to.Add(-1 * time.Hour)
+	if fromString := query.Get("from"); fromString != "" {
+		if from, err = time.Parse(time.RFC3339Nano, fromString); err != nil {
+			return from, to, step, fmt.Errorf("cannot parse from '%s' as an RFC 3339 timestamp", fromString)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, step, fmt.Errorf("from must be before to")
+	}
+	if to.Sub(from) > HistoryQueryMaxRange {
+		return from, to, step, fmt.Errorf("the range must not be longer than %s", HistoryQueryMaxRange)
+	}
+	if stepString := query.Get("step"); stepString != "" {
+		if step, err = time.ParseDuration(stepString); err != nil || step <= 0 {
+			return from, to, step, fmt.Errorf("cannot parse step '%s' as a positive duration", stepString)
+		}
+		if steps := (to.Sub(from) + step - 1) / step; steps > HistoryQueryMaxPoints {
+			return from, to, step, fmt.Errorf("%d steps in the range, at most %d are returned; narrow the range or set a longer step", steps, HistoryQueryMaxPoints)
+		}
+	}
+	return from, to, step, nil
+}
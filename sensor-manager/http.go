@@ -41,12 +41,13 @@ func getParamsFromRequest(req *http.Request) MqttAuthParams {
 	}
 }
 
-func StartBlockingHttpServer(wg *sync.WaitGroup, authDb *AuthDatabase, port uint16) {
+func StartBlockingHttpServer(wg *sync.WaitGroup, authDb *AuthDatabase, broadcaster *ValueBroadcaster, latestValues *LatestValueCache, registry *SensorRegistry, metrics *Metrics, deadLetters *DeadLetterLog, alerts *AlertEngine, history *HistoryStore, driverSequences *DriverSequences, port uint16, tlsParams HttpServerTlsParameters, allowedOrigins []string) {
+	// the broker's auth plugin cannot present a client certificate, so these never require one; see docker-compose.yml
 	http.HandleFunc("/auth", func(writer http.ResponseWriter, request *http.Request) {
 		authParams := getParamsFromRequest(request)
 		if authDb.isAuthenticated(authParams.Username, authParams.Password) {
 			writer.WriteHeader(200)
-			log.Printf("/auth (200) -> %+v", authParams)
+			logDebugf("/auth (200) -> %+v", authParams)
 		} else {
 			writer.WriteHeader(403)
 			log.Printf("/auth (403) -> %+v", authParams)
@@ -57,7 +58,7 @@ func StartBlockingHttpServer(wg *sync.WaitGroup, authDb *AuthDatabase, port uint
 		authParams := getParamsFromRequest(request)
 		if authDb.isSuperuserPreauthenticated(authParams.Username) {
 			writer.WriteHeader(200)
-			log.Printf("/superuser (200) -> %+v", authParams)
+			logDebugf("/superuser (200) -> %+v", authParams)
 		} else {
 			writer.WriteHeader(403)
 			log.Printf("/superuser (403) -> %+v", authParams)
@@ -67,7 +68,7 @@ func StartBlockingHttpServer(wg *sync.WaitGroup, authDb *AuthDatabase, port uint
 		authParams := getParamsFromRequest(request)
 		if authDb.isAuthorized(authParams.Username, authParams.Topic, authParams.AccessType) {
 			writer.WriteHeader(200)
-			log.Printf("/acl (200) -> %+v", authParams)
+			logDebugf("/acl (200) -> %+v", authParams)
 		} else {
 			writer.WriteHeader(403)
 			log.Printf("/acl (403) -> %+v", authParams)
@@ -75,7 +76,7 @@ func StartBlockingHttpServer(wg *sync.WaitGroup, authDb *AuthDatabase, port uint
 	})
 	// TODO: this returns everything to everyone, needs auth through cimi
 	http.HandleFunc("/topics", func(writer http.ResponseWriter, request *http.Request) {
-		serialized, err := json.Marshal(authDb.Topics)
+		serialized, err := json.Marshal(authDb.copyTopics())
 		if err != nil {
 			panic(err)
 		}
@@ -84,7 +85,42 @@ func StartBlockingHttpServer(wg *sync.WaitGroup, authDb *AuthDatabase, port uint
 			panic(err)
 		}
 	})
+	// live values for clients that cannot speak MQTT, see stream.go
+	http.HandleFunc("/api/v1/stream", handleServerSentEvents(authDb, broadcaster))
+	http.HandleFunc("/api/v1/stream/ws", handleWebSocketStream(authDb, broadcaster, allowedOrigins))
+	// see api.go
+	http.HandleFunc(ApiSensorListPath, handleSensorList(authDb, registry))
+	http.HandleFunc(ApiSensorsPath, handleSensorApi(authDb, latestValues, registry, history))
+	// admin tooling may be required to present a client certificate, on top of the administrator token
+	http.HandleFunc(ApiAdminMetricsPath, requireClientCertificate(tlsParams, handleMetrics(authDb, metrics)))
+	http.HandleFunc(ApiAdminRejectionsPath, requireClientCertificate(tlsParams, handleRecentRejections(authDb, deadLetters)))
+	// see alerts.go
+	http.HandleFunc(ApiAdminRulesPath, requireClientCertificate(tlsParams, handleAlertRules(authDb, alerts)))
+	http.HandleFunc(ApiAdminRulesPath+"/", requireClientCertificate(tlsParams, handleAlertRules(authDb, alerts)))
+	// see calibration.go
+	http.HandleFunc(ApiAdminCalibrationsPath, requireClientCertificate(tlsParams, handleCalibrations(authDb, registry)))
+	http.HandleFunc(ApiAdminCalibrationsPath+"/", requireClientCertificate(tlsParams, handleCalibrations(authDb, registry)))
+	http.HandleFunc(ApiAdminDriversPath, requireClientCertificate(tlsParams, handleDriverSequences(authDb, driverSequences)))
 	defer wg.Done()
-	log.Printf("Starting HTTP server on port %d.", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	if !tlsParams.enabled() {
+		if tlsParams.clientCertificatesRequired() {
+			panic(fmt.Errorf("a client CA file is set, but client certificates can only be verified with TLS enabled"))
+		}
+		log.Printf("Starting HTTP server on port %d.", port)
+		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	}
+
+	reloader, err := newCertificateReloader(tlsParams)
+	if err != nil {
+		log.Println(fmt.Errorf("could not load the TLS certificates, panic"))
+		panic(err)
+	}
+	go reloader.watch()
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		TLSConfig: reloader.buildTlsConfig(),
+	}
+	log.Printf("Starting HTTPS server on port %d (client certificates required for the admin API: %t).", port, tlsParams.clientCertificatesRequired())
+	// the certificates come from the TLS config, so no files here
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,68 @@
+package sensormanager
+
+import (
+	"sync"
+	"time"
+)
+
+type latestValueEntry struct {
+	topic      SensorTopic
+	message    OutgoingClientMessage
+	receivedAt time.Time
+}
+
+// the last transformed message per topic (so per sensor and quantity), for clients that poll instead of subscribing
+type LatestValueCache struct {
+	lock   sync.RWMutex
+	values map[string]latestValueEntry
+}
+
+type LatestValueResponse struct {
+	SensorId  string  `json:"sensorId"`
+	Quantity  string  `json:"quantity"`
+	Timestamp string  `json:"timestamp"`
+	Value     float64 `json:"value"`
+	Unit      string  `json:"unit"`
+	// only for calibrated sensors that keep it
+	RawValue *float64 `json:"rawValue,omitempty"`
+	// based on the reading's timestamp, or the time of receipt if that is unparseable
+	AgeSeconds float64 `json:"ageSeconds"`
+}
+
+func NewLatestValueCache() *LatestValueCache {
+	return &LatestValueCache{
+		values: map[string]latestValueEntry{},
+	}
+}
+
+func (receiver *LatestValueCache) update(topic SensorTopic, message OutgoingClientMessage) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	receiver.values[topic.Name] = latestValueEntry{
+		topic:      topic,
+		message:    message,
+		receivedAt: time.Now(),
+	}
+}
+
+func (receiver *LatestValueCache) get(topicName string) (LatestValueResponse, bool) {
+	receiver.lock.RLock()
+	entry, ok := receiver.values[topicName]
+	receiver.lock.RUnlock()
+	if !ok {
+		return LatestValueResponse{}, false
+	}
+	measuredAt, err := time.Parse(time.RFC3339Nano, entry.message.Timestamp)
+	if err != nil {
+		measuredAt = entry.receivedAt
+	}
+	return LatestValueResponse{
+		SensorId:   entry.topic.SensorId,
+		Quantity:   entry.topic.Quantity,
+		Timestamp:  entry.message.Timestamp,
+		Value:      entry.message.Value,
+		Unit:       entry.message.Unit,
+		RawValue:   entry.message.RawValue,
+		AgeSeconds: time.Since(measuredAt).Seconds(),
+	}, true
+}
@@ -0,0 +1,122 @@
+package sensormanager
+
+import (
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"sort"
+	"time"
+)
+
+// the liveness of a sensor is published, retained, on <topic>/status of each of its topics
+const TopicSuffixStatus = "status"
+
+// a sensor is offline after this many expected intervals of silence, but not sooner than the minimum delay;
+// until enough intervals have been seen, the registry's alive timeout is used instead
+const SensorOfflineIntervalFactor = 3
+const SensorOfflineMinimumDelay = 5 * time.Second
+const SensorIntervalMinSamples = 3
+
+// weight of the newest gap in the expected interval
+const SensorIntervalSmoothing = 0.2
+
+// shorter gaps are messages of one burst, e.g. a batch, and say nothing about the interval
+const SensorIntervalMinGap = 50 * time.Millisecond
+
+const SensorLivenessCheckInterval = 1 * time.Second
+
+type SensorStatus string
+
+const (
+	SensorStatusOnline  SensorStatus = "online"
+	SensorStatusOffline SensorStatus = "offline"
+)
+
+// what subscribers of the status topics get whenever a sensor goes silent or resumes
+type SensorStatusMessage struct {
+	SensorId string       `json:"sensorId"`
+	Status   SensorStatus `json:"status"`
+	Since    string       `json:"since"`
+	LastSeen string       `json:"lastSeen"`
+	// zero while not enough messages have been seen
+	ExpectedIntervalSeconds float64 `json:"expectedIntervalSeconds"`
+}
+
+func (receiver *RegisteredSensor) learnInterval(gap time.Duration) {
+	if gap < SensorIntervalMinGap {
+		return
+	}
+	if receiver.IntervalSamples == 0 {
+		receiver.ExpectedIntervalSeconds = gap.Seconds()
+	} else {
+		receiver.ExpectedIntervalSeconds += SensorIntervalSmoothing * (gap.Seconds() - receiver.ExpectedIntervalSeconds)
+	}
+	receiver.IntervalSamples++
+}
+
+func (receiver *RegisteredSensor) offlineAfter(aliveTimeout time.Duration) time.Duration {
+	if receiver.IntervalSamples < SensorIntervalMinSamples {
+		return aliveTimeout
+	}
+	delay := time.Duration(SensorOfflineIntervalFactor * receiver.ExpectedIntervalSeconds * float64(time.Second))
+	if delay < SensorOfflineMinimumDelay {
+		return SensorOfflineMinimumDelay
+	}
+	return delay
+}
+
+func (receiver *RegisteredSensor) isAlive(now time.Time, aliveTimeout time.Duration) bool {
+	return now.Sub(receiver.LastSeen) <= receiver.offlineAfter(aliveTimeout)
+}
+
+// the sensors whose status changed since the last call, sorted by sensor ID; changes are written out immediately
+func (receiver *SensorRegistry) updateStatuses(now time.Time) []SensorStatusMessage {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	changes := []SensorStatusMessage{}
+	for _, sensor := range receiver.Sensors {
+		status := SensorStatusOffline
+		if sensor.isAlive(now, receiver.AliveTimeout) {
+			status = SensorStatusOnline
+		}
+		if status == sensor.Status {
+			continue
+		}
+		sensor.Status = status
+		sensor.StatusSince = now
+		changes = append(changes, SensorStatusMessage{
+			SensorId:                sensor.SensorId,
+			Status:                  status,
+			Since:                   now.UTC().Format(time.RFC3339Nano),
+			LastSeen:                sensor.LastSeen.UTC().Format(time.RFC3339Nano),
+			ExpectedIntervalSeconds: sensor.ExpectedIntervalSeconds,
+		})
+	}
+	if len(changes) > 0 {
+		receiver.writeToFile()
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].SensorId < changes[j].SensorId
+	})
+	return changes
+}
+
+// resumed sensors are noticed on the next check, not with their first message
+func (receiver *SensorRegistry) WatchLiveness(client mqtt.Client, authDb *AuthDatabase) {
+	for now := range time.Tick(SensorLivenessCheckInterval) {
+		for _, change := range receiver.updateStatuses(now) {
+			log.Printf("Sensor %s is %s.", change.SensorId, change.Status)
+			marshaled, err := json.Marshal(change)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			// old names as well, like the values
+			for _, topic := range authDb.getSensorTopics(change.SensorId) {
+				for _, name := range topic.activeNames(now) {
+					client.Publish(name+"/"+TopicSuffixStatus, 1, true, marshaled)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package sensormanager
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+const LogLevelDebug = "debug"
+const LogLevelInfo = "info"
+
+// 1 if per-message and per-request logs are printed; atomic, as it can change on config reload
+var debugLoggingEnabled int32
+
+func isValidLogLevel(level string) bool {
+	return level == LogLevelDebug || level == LogLevelInfo
+}
+
+func setLogLevel(level string) error {
+	switch level {
+	case LogLevelDebug:
+		atomic.StoreInt32(&debugLoggingEnabled, 1)
+	case LogLevelInfo:
+		atomic.StoreInt32(&debugLoggingEnabled, 0)
+	default:
+		return fmt.Errorf("unknown log level %s", level)
+	}
+	return nil
+}
+
+// for everything that happens once per message or request
+func logDebugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debugLoggingEnabled) == 1 {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,51 @@
+package sensormanager
+
+import (
+	"strings"
+	"time"
+)
+
+// splits a multi-quantity message into one message per quantity, single-value messages stay as they are
+func expandMeasurements(incoming IncomingSensorMessage) ([]IncomingSensorMessage, *MessageRejection) {
+	if len(incoming.Measurements) == 0 {
+		return []IncomingSensorMessage{incoming}, nil
+	}
+	if strings.TrimSpace(incoming.Quantity) != "" || strings.TrimSpace(incoming.Unit) != "" || incoming.Value != 0 {
+		return nil, reject(RejectionMixedMeasurements, "sensor %s sent both Measurements and a single Quantity, Value or Unit", incoming.SensorId)
+	}
+	expanded := []IncomingSensorMessage{}
+	for _, measurement := range incoming.Measurements {
+		single := incoming
+		single.Measurements = nil
+		single.Quantity = measurement.Quantity
+		single.Value = measurement.Value
+		single.Unit = measurement.Unit
+		expanded = append(expanded, single)
+	}
+	return expanded, nil
+}
+
+// all or nothing: if one measurement is invalid, the whole message is rejected
+func prepareReadings(incoming IncomingSensorMessage, limits ValidationLimits, now time.Time) ([]IncomingSensorMessage, *MessageRejection) {
+	expanded, rejection := expandMeasurements(incoming)
+	if rejection != nil {
+		return nil, rejection
+	}
+	readings := []IncomingSensorMessage{}
+	seenQuantities := map[string]struct{}{}
+	for _, single := range expanded {
+		if rejection := validateIncomingMessage(single, limits, now); rejection != nil {
+			return nil, rejection
+		}
+		normalized, rejection := normalizeIncomingMessage(single)
+		if rejection != nil {
+			return nil, rejection
+		}
+		if _, ok := seenQuantities[normalized.Quantity]; ok {
+			return nil, reject(RejectionDuplicateQuantity, "sensor %s sent quantity %s more than once", normalized.SensorId, normalized.Quantity)
+		}
+		seenQuantities[normalized.Quantity] = struct{}{}
+		readings = append(readings, normalized)
+	}
+	return readings, nil
+}
@@ -0,0 +1,97 @@
+package sensormanager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// counters and gauges in the Prometheus text format, so they can be scraped as well as read by humans
+type Metrics struct {
+	lock     sync.Mutex
+	counters map[string]uint64
+	gauges   map[string]int64
+	help     map[string]string
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: map[string]uint64{},
+		gauges:   map[string]int64{},
+		help:     map[string]string{},
+	}
+}
+
+// labels are key, value pairs
+func buildMetricKey(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escaped))
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+func (receiver *Metrics) describe(name string, help string) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	receiver.help[name] = help
+}
+
+func (receiver *Metrics) incrementCounter(name string, labels ...string) {
+	receiver.addToCounter(1, name, labels...)
+}
+
+func (receiver *Metrics) addToCounter(amount uint64, name string, labels ...string) {
+	key := buildMetricKey(name, labels...)
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	receiver.counters[key] += amount
+}
+
+func (receiver *Metrics) setGauge(value int64, name string, labels ...string) {
+	key := buildMetricKey(name, labels...)
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	receiver.gauges[key] = value
+}
+
+func (receiver *Metrics) format() string {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	byName := map[string][]string{}
+	types := map[string]string{}
+	for key, value := range receiver.counters {
+		name := strings.SplitN(key, "{", 2)[0]
+		byName[name] = append(byName[name], fmt.Sprintf("%s %d", key, value))
+		types[name] = "counter"
+	}
+	for key, value := range receiver.gauges {
+		name := strings.SplitN(key, "{", 2)[0]
+		byName[name] = append(byName[name], fmt.Sprintf("%s %d", key, value))
+		types[name] = "gauge"
+	}
+	names := []string{}
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	builder := strings.Builder{}
+	for _, name := range names {
+		if help, ok := receiver.help[name]; ok {
+			builder.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+		}
+		builder.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, types[name]))
+		lines := byName[name]
+		sort.Strings(lines)
+		for _, line := range lines {
+			builder.WriteString(line + "\n")
+		}
+	}
+	return builder.String()
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"log"
+	"mf2c-sensor-manager/codec"
 	"os"
 	"sync"
 	"time"
@@ -13,27 +14,10 @@ import (
 const TopicSensorReceive = "/sensor-manager/sensor-incoming"
 const TopicClientPublishRoot = "/sensor-manager/values/"
 
-type IncomingSensorMessage struct {
-	// an ID that differentiates this piece of hardware sensor from others
-	SensorId string
-	// the type of the sensor: AM2302 etc
-	SensorType string
-	// the SI dimension (temperature, humidity, weight, etc)
-	Quantity string
-	// the timestamp in RFC 3339
-	Timestamp string
-	Value     float64
-	// the SI unit (deg. celsius, RH%, kg, etc), without SI prefixes (except kg, which is a base unit)
-	Unit string
-}
-
-// only defines values not known prior to the request
-// e.g. not the sensor type, because this sensor's data has been requested
-type OutgoingClientMessage struct {
-	Timestamp string
-	Value     float64
-	Unit      string
-}
+// the wire formats are in the codec package, drivers and subscribers share them
+type IncomingSensorMessage = codec.Reading
+type Measurement = codec.Measurement
+type OutgoingClientMessage = codec.Value
 
 func ConnectMqttClient(address string, clientId string, username string, password string) mqtt.Client {
 	log.Printf("Building a new MQTT client with id %s.", clientId)
@@ -70,11 +54,6 @@ func ConnectMqttClient(address string, clientId string, username string, passwor
 	return mqttClient
 }
 
-func validateIncomingMessage(incoming IncomingSensorMessage) bool {
-	_, err := time.Parse(time.RFC3339Nano, incoming.Timestamp)
-	return err == nil
-}
-
 func transformMessage(incoming IncomingSensorMessage) OutgoingClientMessage {
 	return OutgoingClientMessage{
 		Timestamp: incoming.Timestamp,
@@ -83,36 +62,149 @@ func transformMessage(incoming IncomingSensorMessage) OutgoingClientMessage {
 	}
 }
 
-func StartMessageTransformations(wg *sync.WaitGroup, authDb *AuthDatabase, subscribeClient mqtt.Client) {
+func rejectIncomingMessage(client mqtt.Client, metrics *Metrics, deadLetters *DeadLetterLog, topic string, payload []byte, driver string, rejection *MessageRejection) {
+	log.Printf("Rejected a message from driver %s, see %s: %s", driver, TopicDeadLetter, rejection)
+	metrics.incrementCounter("sensor_manager_rejected_messages_total", "driver", driver, "reason", string(rejection.Reason))
+	publishDeadLetter(client, deadLetters, newDeadLetter(topic, payload, driver, rejection))
+}
+
+func StartMessageTransformations(wg *sync.WaitGroup, authDb *AuthDatabase, broadcaster *ValueBroadcaster, latestValues *LatestValueCache, registry *SensorRegistry,
+	metrics *Metrics, deadLetters *DeadLetterLog, alerts *AlertEngine, history *HistoryStore, virtualSensors *VirtualSensors, topicSequences *TopicSequences, driverSequences *DriverSequences,
+	validationLimits ValidationLimits, publishSettings PublishSettings, orderingSettings OrderingSettings, pipelineSettings PipelineSettings,
+	subscribeClient mqtt.Client) {
 	defer wg.Done()
 	log.Println("Starting message transformations.")
-	if token := subscribeClient.Subscribe(TopicSensorReceive, 0, func(receiveClient mqtt.Client, message mqtt.Message) {
-		log.Printf("Got sensor driver message.")
-		unmarshaled := IncomingSensorMessage{}
-		err := json.Unmarshal(message.Payload(), &unmarshaled)
-		if err != nil {
-			log.Println(err)
-		} else {
-			if !validateIncomingMessage(unmarshaled) {
-				log.Printf("Invalid timestamp format for incoming message, skipping: %s", unmarshaled.Timestamp)
-			} else {
-				transformedRemarshaled, err := json.Marshal(transformMessage(unmarshaled))
-				if err != nil {
-					log.Println(err)
-				} else {
-					outTopicName, err := authDb.getTopicForSensor(unmarshaled.SensorId)
-					if err != nil {
-						newTopicName, err := authDb.addSensorTopic(unmarshaled.SensorId, unmarshaled.Quantity)
-						if err != nil {
-							panic(err)
-						}
-						// go is such agile and also very good language, wow
-						outTopicName = newTopicName
-					}
-					log.Printf("Message transformation successful, publishing on the outgoing topic: %s", outTopicName)
-					receiveClient.Publish(outTopicName, 0, false, transformedRemarshaled)
+	metrics.describe("sensor_manager_rejected_messages_total", "Incoming messages rejected by validation, per driver and reason.")
+	metrics.describe("sensor_manager_incoming_messages_total", "Incoming messages per detected payload format.")
+	publisher := newPublisher(subscribeClient, publishSettings, metrics)
+	aggregates := newOutgoingAggregates(metrics)
+	go aggregates.flushPeriodically(publisher)
+	go alerts.checkStalePeriodically(publisher)
+
+	provenance := newProvenanceStamper()
+	// the readings of one incoming message, or one released by the reorder policy, or those computed from them; now is when they arrived
+	var publishReadings func(readings []IncomingSensorMessage, batches *outgoingBatches, now time.Time)
+	publishReadings = func(readings []IncomingSensorMessage, batches *outgoingBatches, now time.Time) {
+		outTopicNames := []string{}
+		calibrated := []IncomingSensorMessage{}
+		for _, reading := range readings {
+			// everything after this gets the corrected value, see calibration.go
+			corrected, rawValue, isCalibrated, rejection := registry.calibrate(reading)
+			if rejection != nil {
+				// the normalized reading, as the message may hold others; its value was validated as finite
+				payload, _ := json.Marshal(reading)
+				rejectIncomingMessage(subscribeClient, metrics, deadLetters, TopicSensorReceive, payload, getDriver(reading), rejection)
+				continue
+			}
+			reading = corrected
+			quality := []string{}
+			if isCalibrated {
+				quality = append(quality, QualityCalibrated)
+			}
+			if virtualSensors.isVirtual(reading.SensorId) {
+				quality = append(quality, QualityComputed)
+			}
+			outTopic, err := authDb.resolveSensorTopic(reading)
+			if err != nil {
+				// e.g. an auth database entry already holds the sensor ID; the other readings may still go through
+				payload, _ := json.Marshal(reading)
+				rejectIncomingMessage(subscribeClient, metrics, deadLetters, TopicSensorReceive, payload, getDriver(reading), reject(RejectionUnresolvedTopic, "no topic for sensor %s and quantity %s: %s", reading.SensorId, reading.Quantity, err))
+				continue
+			}
+			transformed := transformMessage(reading)
+			transformed.RawValue = rawValue
+			// the same number on the topic and all of its variants
+			transformed.Sequence = topicSequences.next(outTopic)
+			transformedRemarshaled, err := json.Marshal(transformed)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			logDebugf("Message transformation successful, publishing on the outgoing topic: %s", outTopic.Name)
+			// old names until the end of their deprecation window, see topiclayout.go
+			policy := publishSettings.policyFor(reading.SensorId, reading.Quantity)
+			for _, name := range outTopic.activeNames(now) {
+				publisher.publish(name, policy, transformedRemarshaled)
+				broadcaster.publish(name, transformed)
+			}
+			enveloped := transformed
+			enveloped.Provenance = provenance.stamp(outTopic, reading, now, quality)
+			publishTopicVariants(publisher, broadcaster, batches, aggregates, authDb.layout, outTopic, policy, enveloped)
+			latestValues.update(outTopic, transformed)
+			alerts.evaluate(publisher, reading, outTopic.Name, now)
+			history.append(reading)
+			outTopicNames = append(outTopicNames, outTopic.Name)
+			calibrated = append(calibrated, reading)
+		}
+		registry.observe(calibrated, outTopicNames)
+		// inputs of virtual sensors are never virtual, so this recurses once at most, see validateVirtualSensors
+		if derived := virtualSensors.update(calibrated); len(derived) > 0 {
+			publishReadings(derived, batches, now)
+		}
+	}
+	sequencer := newReadingSequencer(orderingSettings, metrics)
+	pipeline := newProcessingPipeline(pipelineSettings, metrics)
+	if orderingSettings.OutOfOrder == OutOfOrderPolicyReorder {
+		go sequencer.releasePeriodically(func(reading IncomingSensorMessage, arrivedAt time.Time) {
+			pipeline.enqueue(pipelineJob{readings: []IncomingSensorMessage{reading}, receivedAt: arrivedAt, released: true})
+		})
+	}
+
+	pipeline.run(func(job pipelineJob) {
+		batches := newOutgoingBatches()
+		if job.released {
+			publishReadings(job.readings, batches, job.receivedAt)
+			batches.publish(publisher)
+			return
+		}
+		for i, unmarshaled := range job.readings {
+			// rejected readings were not lost
+			driverSequences.observe(unmarshaled)
+			readings, rejection := prepareReadings(unmarshaled, validationLimits, job.receivedAt)
+			if rejection == nil && virtualSensors.isVirtual(unmarshaled.SensorId) {
+				rejection = reject(RejectionVirtualSensor, "sensor %s is a virtual sensor, its values are computed by the sensor manager", unmarshaled.SensorId)
+			}
+			if rejection != nil {
+				payload := job.payload
+				if job.isBatch {
+					payload, rejection = rejectBatchReading(job.indices[i], unmarshaled, rejection)
 				}
+				rejectIncomingMessage(subscribeClient, metrics, deadLetters, job.topic, payload, getDriver(unmarshaled), rejection)
+				continue
 			}
+			// duplicates and, depending on the policy, out of order readings are left out, see ordering.go
+			publishReadings(sequencer.admit(readings, job.receivedAt), batches, job.receivedAt)
+		}
+		batches.publish(publisher)
+	})
+
+	// only decoding happens here, the rest is up to the pipeline's workers, see pipeline.go
+	if token := subscribeClient.Subscribe(TopicSensorReceive, publishSettings.IncomingQos, func(receiveClient mqtt.Client, message mqtt.Message) {
+		logDebugf("Got sensor driver message.")
+		messages, format, isBatch, rejection := decodeIncomingPayload(message.Payload(), validationLimits.MaxBatchSize)
+		if format != "" {
+			metrics.incrementCounter("sensor_manager_incoming_messages_total", "format", string(format))
+		}
+		if rejection != nil {
+			rejectIncomingMessage(receiveClient, metrics, deadLetters, message.Topic(), message.Payload(), UnknownDriver, rejection)
+			return
+		}
+		// one job per sensor, in the order of the message
+		jobs := []pipelineJob{}
+		jobIndices := map[string]int{}
+		now := time.Now()
+		for i, unmarshaled := range messages {
+			index, ok := jobIndices[unmarshaled.SensorId]
+			if !ok {
+				index = len(jobs)
+				jobIndices[unmarshaled.SensorId] = index
+				jobs = append(jobs, pipelineJob{topic: message.Topic(), payload: message.Payload(), isBatch: isBatch, receivedAt: now})
+			}
+			jobs[index].indices = append(jobs[index].indices, i)
+			jobs[index].readings = append(jobs[index].readings, unmarshaled)
+		}
+		for _, job := range jobs {
+			pipeline.enqueue(job)
 		}
 	}); token.Wait() && token.Error() != nil {
 		log.Println(token.Error())
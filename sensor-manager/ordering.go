@@ -0,0 +1,163 @@
+package sensormanager
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// what happens to readings older than the newest one of their sensor and quantity
+type OutOfOrderPolicy string
+
+const (
+	OutOfOrderPolicyDrop OutOfOrderPolicy = "drop"
+	OutOfOrderPolicyPass OutOfOrderPolicy = "pass"
+	// readings are held back for the reorder delay and published in timestamp order;
+	// those arriving after a newer one has been published are dropped
+	OutOfOrderPolicyReorder OutOfOrderPolicy = "reorder"
+)
+
+// how often held back readings are checked for release
+const ReorderReleaseInterval = 100 * time.Millisecond
+
+type OrderingSettings struct {
+	// by reading timestamp; zero disables deduplication
+	DedupWindow  time.Duration
+	OutOfOrder   OutOfOrderPolicy
+	ReorderDelay time.Duration
+}
+
+func parseOutOfOrderPolicy(name string) (OutOfOrderPolicy, error) {
+	switch policy := OutOfOrderPolicy(name); policy {
+	case OutOfOrderPolicyDrop, OutOfOrderPolicyPass, OutOfOrderPolicyReorder:
+		return policy, nil
+	}
+	return "", fmt.Errorf("out of order policy must be %s, %s or %s, is '%s'", OutOfOrderPolicyDrop, OutOfOrderPolicyPass, OutOfOrderPolicyReorder, name)
+}
+
+// per sensor and quantity
+type readingSequence struct {
+	// the newest timestamp admitted
+	latest time.Time
+	// the newest timestamp published, for the reorder policy
+	released time.Time
+	// timestamps within the dedup window of latest, in Unix nanoseconds
+	seen map[int64]struct{}
+}
+
+type heldReading struct {
+	reading    IncomingSensorMessage
+	measuredAt time.Time
+	arrivedAt  time.Time
+}
+
+// drops duplicate readings and applies the out of order policy, before anything is published
+type readingSequencer struct {
+	lock      sync.Mutex
+	settings  OrderingSettings
+	sequences map[string]*readingSequence
+	held      []heldReading
+	metrics   *Metrics
+}
+
+func newReadingSequencer(settings OrderingSettings, metrics *Metrics) *readingSequencer {
+	metrics.describe("sensor_manager_duplicate_readings_total", "Readings dropped because a reading with the same sensor ID, quantity and timestamp was seen before.")
+	metrics.describe("sensor_manager_out_of_order_readings_total", "Readings older than the newest one of their sensor and quantity, per action taken.")
+	return &readingSequencer{
+		settings:  settings,
+		sequences: map[string]*readingSequence{},
+		metrics:   metrics,
+	}
+}
+
+// the readings to publish right away, in order; with the reorder policy, all of them are held back instead
+func (receiver *readingSequencer) admit(readings []IncomingSensorMessage, now time.Time) []IncomingSensorMessage {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	admitted := []IncomingSensorMessage{}
+	for _, reading := range readings {
+		// validated beforehand
+		measuredAt, _ := time.Parse(time.RFC3339Nano, reading.Timestamp)
+		key := buildSensorTopicKey(reading.SensorId, reading.Quantity)
+		sequence, ok := receiver.sequences[key]
+		if !ok {
+			sequence = &readingSequence{seen: map[int64]struct{}{}}
+			receiver.sequences[key] = sequence
+		}
+		if _, duplicate := sequence.seen[measuredAt.UnixNano()]; duplicate {
+			logDebugf("Dropping a duplicate reading of sensor %s, quantity %s at %s.", reading.SensorId, reading.Quantity, reading.Timestamp)
+			receiver.metrics.incrementCounter("sensor_manager_duplicate_readings_total")
+			continue
+		}
+		if measuredAt.Before(sequence.latest) {
+			action := receiver.settings.OutOfOrder
+			if action == OutOfOrderPolicyReorder && measuredAt.Before(sequence.released) {
+				action = OutOfOrderPolicyDrop
+			}
+			receiver.metrics.incrementCounter("sensor_manager_out_of_order_readings_total", "action", string(action))
+			if action == OutOfOrderPolicyDrop {
+				logDebugf("Dropping an out of order reading of sensor %s, quantity %s at %s.", reading.SensorId, reading.Quantity, reading.Timestamp)
+				continue
+			}
+		}
+		sequence.remember(measuredAt, receiver.settings.DedupWindow)
+		if receiver.settings.OutOfOrder == OutOfOrderPolicyReorder {
+			receiver.held = append(receiver.held, heldReading{reading: reading, measuredAt: measuredAt, arrivedAt: now})
+			continue
+		}
+		admitted = append(admitted, reading)
+	}
+	return admitted
+}
+
+func (receiver *readingSequence) remember(measuredAt time.Time, dedupWindow time.Duration) {
+	if measuredAt.After(receiver.latest) {
+		receiver.latest = measuredAt
+	}
+	if dedupWindow <= 0 {
+		return
+	}
+	receiver.seen[measuredAt.UnixNano()] = struct{}{}
+	oldest := receiver.latest.Add(-dedupWindow).UnixNano()
+	for timestamp := range receiver.seen {
+		if timestamp < oldest {
+			delete(receiver.seen, timestamp)
+		}
+	}
+}
+
+// the held back readings whose delay is over, in timestamp order
+func (receiver *readingSequencer) releaseDue(now time.Time) []heldReading {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	due := []heldReading{}
+	kept := receiver.held[:0]
+	for _, held := range receiver.held {
+		if now.Sub(held.arrivedAt) >= receiver.settings.ReorderDelay {
+			due = append(due, held)
+		} else {
+			kept = append(kept, held)
+		}
+	}
+	receiver.held = kept
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].measuredAt.Before(due[j].measuredAt)
+	})
+	for _, held := range due {
+		sequence := receiver.sequences[buildSensorTopicKey(held.reading.SensorId, held.reading.Quantity)]
+		if held.measuredAt.After(sequence.released) {
+			sequence.released = held.measuredAt
+		}
+	}
+	return due
+}
+
+// release hands the readings to the worker of their sensor, so they are not published concurrently with newer ones
+func (receiver *readingSequencer) releasePeriodically(release func(reading IncomingSensorMessage, arrivedAt time.Time)) {
+	for now := range time.Tick(ReorderReleaseInterval) {
+		for _, held := range receiver.releaseDue(now) {
+			release(held.reading, held.arrivedAt)
+		}
+	}
+}
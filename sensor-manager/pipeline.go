@@ -0,0 +1,128 @@
+package sensormanager
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// what happens to incoming messages while the queue of their worker is full
+type BackpressurePolicy string
+
+const (
+	// the MQTT client waits for room, which holds up the messages of all sensors
+	BackpressurePolicyBlock BackpressurePolicy = "block"
+	// the incoming message is dropped
+	BackpressurePolicyDropNewest BackpressurePolicy = "drop-newest"
+	// the oldest queued message is dropped to make room
+	BackpressurePolicyDropOldest BackpressurePolicy = "drop-oldest"
+)
+
+type PipelineSettings struct {
+	Workers int
+	// per worker, in incoming messages; a batch counts once per sensor in it
+	QueueSize    int
+	Backpressure BackpressurePolicy
+}
+
+func parseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch policy := BackpressurePolicy(name); policy {
+	case BackpressurePolicyBlock, BackpressurePolicyDropNewest, BackpressurePolicyDropOldest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("backpressure policy must be %s, %s or %s, is '%s'", BackpressurePolicyBlock, BackpressurePolicyDropNewest, BackpressurePolicyDropOldest, name)
+}
+
+// the readings of one sensor from one incoming message
+type pipelineJob struct {
+	topic   string
+	payload []byte
+	isBatch bool
+	// of the readings in the batch, for rejections
+	indices    []int
+	readings   []IncomingSensorMessage
+	receivedAt time.Time
+	// held back by the reorder policy, already validated and admitted, see ordering.go
+	released bool
+}
+
+// decouples the MQTT client from validation and publishing; the readings of one sensor always go to the same worker,
+// so they are processed in the order they arrived. Virtual sensors are computed by the worker of the input that
+// completed them, so their values may be published out of order when their inputs arrive at the same time.
+type processingPipeline struct {
+	settings PipelineSettings
+	queues   []chan pipelineJob
+	metrics  *Metrics
+}
+
+func newProcessingPipeline(settings PipelineSettings, metrics *Metrics) *processingPipeline {
+	metrics.describe("sensor_manager_pipeline_queue_depth", "Incoming messages waiting for processing, per worker.")
+	metrics.describe("sensor_manager_pipeline_blocked_messages_total", "Incoming messages the MQTT client had to wait for room for, with the block policy.")
+	metrics.describe("sensor_manager_pipeline_dropped_messages_total", "Incoming messages dropped because their worker's queue was full, per backpressure policy.")
+	pipeline := &processingPipeline{settings: settings, metrics: metrics}
+	for i := 0; i < settings.Workers; i++ {
+		pipeline.queues = append(pipeline.queues, make(chan pipelineJob, settings.QueueSize))
+		metrics.setGauge(0, "sensor_manager_pipeline_queue_depth", "worker", strconv.Itoa(i))
+	}
+	return pipeline
+}
+
+func (receiver *processingPipeline) workerFor(sensorId string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(sensorId))
+	return int(hash.Sum32() % uint32(len(receiver.queues)))
+}
+
+func (receiver *processingPipeline) updateDepth(worker int) {
+	receiver.metrics.setGauge(int64(len(receiver.queues[worker])), "sensor_manager_pipeline_queue_depth", "worker", strconv.Itoa(worker))
+}
+
+func (receiver *processingPipeline) drop(job pipelineJob) {
+	logDebugf("Queue full, dropping %d readings of sensor %s.", len(job.readings), job.readings[0].SensorId)
+	receiver.metrics.incrementCounter("sensor_manager_pipeline_dropped_messages_total", "policy", string(receiver.settings.Backpressure))
+}
+
+// called from the MQTT client and for released readings; the job has at least one reading
+func (receiver *processingPipeline) enqueue(job pipelineJob) {
+	worker := receiver.workerFor(job.readings[0].SensorId)
+	queue := receiver.queues[worker]
+	defer receiver.updateDepth(worker)
+	select {
+	case queue <- job:
+		return
+	default:
+	}
+	switch receiver.settings.Backpressure {
+	case BackpressurePolicyBlock:
+		receiver.metrics.incrementCounter("sensor_manager_pipeline_blocked_messages_total")
+		queue <- job
+	case BackpressurePolicyDropNewest:
+		receiver.drop(job)
+	case BackpressurePolicyDropOldest:
+		// the worker may have made room in the meantime, then nothing is dropped
+		for {
+			select {
+			case queue <- job:
+				return
+			default:
+			}
+			select {
+			case oldest := <-queue:
+				receiver.drop(oldest)
+			default:
+			}
+		}
+	}
+}
+
+func (receiver *processingPipeline) run(process func(job pipelineJob)) {
+	for worker, queue := range receiver.queues {
+		go func(worker int, queue chan pipelineJob) {
+			for job := range queue {
+				receiver.updateDepth(worker)
+				process(job)
+			}
+		}(worker, queue)
+	}
+}
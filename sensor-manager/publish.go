@@ -0,0 +1,94 @@
+package sensormanager
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"strconv"
+	"time"
+)
+
+// how long a publish may take before it counts as failed
+const PublishTimeout = 10 * time.Second
+
+var errPublishTimeout = fmt.Errorf("not completed within %s", PublishTimeout)
+
+type PublishPolicy struct {
+	Qos    byte
+	Retain bool
+}
+
+type PublishSettings struct {
+	IncomingQos byte
+	Default     PublishPolicy
+	// keyed by normalized quantity name
+	Quantities map[string]PublishPolicyOverride
+	Sensors    map[string]PublishPolicyOverride
+	Retries    int
+	RetryDelay time.Duration
+}
+
+func (receiver PublishPolicy) override(override PublishPolicyOverride) PublishPolicy {
+	if override.Qos != nil {
+		receiver.Qos = byte(*override.Qos)
+	}
+	if override.Retain != nil {
+		receiver.Retain = *override.Retain
+	}
+	return receiver
+}
+
+// the sensor's settings win over the quantity's, which win over the defaults
+func (receiver PublishSettings) policyFor(sensorId string, quantity string) PublishPolicy {
+	policy := receiver.Default
+	if override, ok := receiver.Quantities[quantity]; ok {
+		policy = policy.override(override)
+	}
+	if override, ok := receiver.Sensors[sensorId]; ok {
+		policy = policy.override(override)
+	}
+	return policy
+}
+
+// publishes with retries, counting failures
+type Publisher struct {
+	client   mqtt.Client
+	settings PublishSettings
+	metrics  *Metrics
+}
+
+func newPublisher(client mqtt.Client, settings PublishSettings, metrics *Metrics) *Publisher {
+	metrics.describe("sensor_manager_publish_retries_total", "Publishes to outgoing topics that failed and were retried.")
+	metrics.describe("sensor_manager_failed_publishes_total", "Publishes to outgoing topics that failed after all retries.")
+	return &Publisher{client: client, settings: settings, metrics: metrics}
+}
+
+// does not block: waiting for the token inside the MQTT callback could deadlock the client
+func (receiver *Publisher) publish(topic string, policy PublishPolicy, payload []byte) {
+	token := receiver.client.Publish(topic, policy.Qos, policy.Retain, payload)
+	go receiver.awaitPublish(token, topic, policy, payload)
+}
+
+func (receiver *Publisher) awaitPublish(token mqtt.Token, topic string, policy PublishPolicy, payload []byte) {
+	for attempt := 0; ; attempt++ {
+		var err error
+		if !token.WaitTimeout(PublishTimeout) {
+			err = errPublishTimeout
+		} else {
+			err = token.Error()
+		}
+		if err == nil {
+			return
+		}
+		qos := strconv.Itoa(int(policy.Qos))
+		if attempt >= receiver.settings.Retries {
+			log.Printf("Publishing on %s failed after %d attempts: %s", topic, attempt+1, err)
+			receiver.metrics.incrementCounter("sensor_manager_failed_publishes_total", "qos", qos)
+			return
+		}
+		logDebugf("Publishing on %s failed, retrying: %s", topic, err)
+		receiver.metrics.incrementCounter("sensor_manager_publish_retries_total", "qos", qos)
+		time.Sleep(receiver.settings.RetryDelay)
+		token = receiver.client.Publish(topic, policy.Qos, policy.Retain, payload)
+	}
+}
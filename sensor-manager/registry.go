@@ -0,0 +1,274 @@
+package sensormanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// last seen times change with every message, so they are only written out this often
+const SensorRegistryPersistInterval = 30 * time.Second
+
+// what is known about a sensor beyond its topic, collected from the messages flowing through
+type RegisteredSensor struct {
+	SensorId string `json:"sensorId"`
+	// topic, quantity and unit of the sensor's first quantity, see Measurements for all of them
+	Topic         string                  `json:"topic"`
+	Quantity      string                  `json:"quantity"`
+	SensorType    string                  `json:"sensorType"`
+	Unit          string                  `json:"unit"`
+	Measurements  []RegisteredMeasurement `json:"measurements"`
+	HardwareModel string                  `json:"hardwareModel"`
+	// the CIMI service of the driver container, empty if the hardware model is unknown
+	Driver       string    `json:"driver"`
+	FirstSeen    time.Time `json:"firstSeen"`
+	LastSeen     time.Time `json:"lastSeen"`
+	MessageCount uint64    `json:"messageCount"`
+	// learned from the gaps between messages, see liveness.go
+	ExpectedIntervalSeconds float64 `json:"expectedIntervalSeconds"`
+	IntervalSamples         uint64  `json:"intervalSamples"`
+	// as last published on the sensor's status topics
+	Status      SensorStatus `json:"status"`
+	StatusSince time.Time    `json:"statusSince"`
+}
+
+// sorted by quantity
+type RegisteredMeasurement struct {
+	Quantity string `json:"quantity"`
+	Unit     string `json:"unit"`
+	Topic    string `json:"topic"`
+}
+
+type RegisteredSensorResponse struct {
+	RegisteredSensor
+	Alive bool `json:"alive"`
+	// set through the admin API, see calibration.go
+	Calibration SensorCalibration `json:"calibration,omitempty"`
+}
+
+type SensorRegistry struct {
+	Filename string
+	Sensors  map[string]*RegisteredSensor
+	// by sensor ID, also for sensors that have not sent yet
+	Calibrations map[string]SensorCalibration
+	// sensors without a message for longer than this are not alive, until their interval is known (see liveness.go)
+	AliveTimeout time.Duration `json:"-"`
+	lock         sync.RWMutex
+	dirty        bool
+}
+
+type SensorRegistryFilter struct {
+	Quantity      string
+	SensorType    string
+	HardwareModel string
+	// nil matches both
+	Alive *bool
+}
+
+func LoadOrCreateSensorRegistry(filename string, aliveTimeout time.Duration) *SensorRegistry {
+	registry := &SensorRegistry{
+		Filename:     filename,
+		Sensors:      map[string]*RegisteredSensor{},
+		Calibrations: map[string]SensorCalibration{},
+		AliveTimeout: aliveTimeout,
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("Reading sensor registry file %s failed, creating anew.", filename)
+		err = os.MkdirAll(path.Dir(filename), 0776)
+		if err != nil {
+			log.Println(fmt.Errorf("could not create sensor registry parent directories, panic"))
+			panic(err)
+		}
+		registry.writeToFile()
+		return registry
+	}
+
+	log.Printf("Sensor registry file %s read successfully.", filename)
+	if err := json.Unmarshal(contents, registry); err != nil {
+		log.Println(fmt.Errorf("failed to unmarshal sensor registry, panic"))
+		panic(err)
+	}
+	// the file may have been moved
+	registry.Filename = filename
+	// files from before calibrations
+	if registry.Calibrations == nil {
+		registry.Calibrations = map[string]SensorCalibration{}
+	}
+	return registry
+}
+
+// must be called with the lock held
+func (receiver *SensorRegistry) writeToFile() {
+	serialized, err := json.Marshal(receiver)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(receiver.Filename, serialized, 0660)
+	if err != nil {
+		log.Println(fmt.Errorf("error writing sensor registry file"))
+		log.Println(err)
+	}
+	receiver.dirty = false
+}
+
+func (receiver *SensorRegistry) PersistPeriodically() {
+	for range time.Tick(SensorRegistryPersistInterval) {
+		receiver.lock.Lock()
+		if receiver.dirty {
+			receiver.writeToFile()
+		}
+		receiver.lock.Unlock()
+	}
+}
+
+func mergeMeasurements(existing []RegisteredMeasurement, readings []IncomingSensorMessage, topicNames []string) []RegisteredMeasurement {
+	merged := append([]RegisteredMeasurement{}, existing...)
+	for i, reading := range readings {
+		measurement := RegisteredMeasurement{Quantity: reading.Quantity, Unit: reading.Unit, Topic: topicNames[i]}
+		found := false
+		for j := range merged {
+			if merged[j].Quantity == reading.Quantity {
+				merged[j] = measurement
+				found = true
+			}
+		}
+		if !found {
+			merged = append(merged, measurement)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Quantity < merged[j].Quantity
+	})
+	return merged
+}
+
+// one call per incoming message, with the readings it was split into and the topic of each
+// metadata changes are written out immediately, last seen times only periodically
+func (receiver *SensorRegistry) observe(readings []IncomingSensorMessage, topicNames []string) {
+	if len(readings) == 0 {
+		return
+	}
+	incoming := readings[0]
+	now := time.Now()
+	driver := ""
+	if incoming.HardwareModel != "" {
+		driver = SensorDriverContainer{SensorHardwareModel: incoming.HardwareModel}.getCimiServiceName()
+	}
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	sensor, ok := receiver.Sensors[incoming.SensorId]
+	if !ok {
+		sensor = &RegisteredSensor{
+			SensorId:  incoming.SensorId,
+			FirstSeen: now,
+		}
+		receiver.Sensors[incoming.SensorId] = sensor
+		log.Printf("Registered new sensor %s.", incoming.SensorId)
+	}
+	measurements := mergeMeasurements(sensor.Measurements, readings, topicNames)
+	// the first quantity stays the first one, like the sensor's first topic in the auth database
+	primary := RegisteredMeasurement{Quantity: incoming.Quantity, Unit: incoming.Unit, Topic: topicNames[0]}
+	for _, measurement := range measurements {
+		if sensor.Quantity != "" && measurement.Quantity == sensor.Quantity {
+			primary = measurement
+		}
+	}
+	changed := !ok ||
+		sensor.Topic != primary.Topic ||
+		sensor.Quantity != primary.Quantity ||
+		sensor.SensorType != incoming.SensorType ||
+		sensor.Unit != primary.Unit ||
+		!reflect.DeepEqual(sensor.Measurements, measurements) ||
+		sensor.HardwareModel != incoming.HardwareModel ||
+		sensor.Driver != driver
+	sensor.Topic = primary.Topic
+	sensor.Quantity = primary.Quantity
+	sensor.SensorType = incoming.SensorType
+	sensor.Unit = primary.Unit
+	sensor.Measurements = measurements
+	sensor.HardwareModel = incoming.HardwareModel
+	sensor.Driver = driver
+	if ok {
+		sensor.learnInterval(now.Sub(sensor.LastSeen))
+	}
+	sensor.LastSeen = now
+	sensor.MessageCount++
+	if changed {
+		receiver.writeToFile()
+	} else {
+		receiver.dirty = true
+	}
+}
+
+func (receiver *RegisteredSensor) hasQuantity(quantity string) bool {
+	if receiver.Quantity == quantity {
+		return true
+	}
+	for _, measurement := range receiver.Measurements {
+		if measurement.Quantity == quantity {
+			return true
+		}
+	}
+	return false
+}
+
+func (receiver *RegisteredSensor) isAnyTopicReadable(readable func(topicName string) bool) bool {
+	if readable(receiver.Topic) {
+		return true
+	}
+	for _, measurement := range receiver.Measurements {
+		if readable(measurement.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (receiver *SensorRegistry) toResponse(sensor *RegisteredSensor) RegisteredSensorResponse {
+	return RegisteredSensorResponse{
+		RegisteredSensor: *sensor,
+		Alive:            sensor.isAlive(time.Now(), receiver.AliveTimeout),
+		Calibration:      receiver.Calibrations[sensor.SensorId],
+	}
+}
+
+func (receiver *SensorRegistry) get(sensorId string) (RegisteredSensorResponse, bool) {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	sensor, ok := receiver.Sensors[sensorId]
+	if !ok {
+		return RegisteredSensorResponse{}, false
+	}
+	return receiver.toResponse(sensor), true
+}
+
+// sorted by sensor ID; readable decides which sensors the caller may see at all, one readable quantity suffices
+func (receiver *SensorRegistry) list(filter SensorRegistryFilter, readable func(topicName string) bool) []RegisteredSensorResponse {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	result := []RegisteredSensorResponse{}
+	for _, sensor := range receiver.Sensors {
+		response := receiver.toResponse(sensor)
+		if (filter.Quantity != "" && !sensor.hasQuantity(filter.Quantity)) ||
+			(filter.SensorType != "" && filter.SensorType != sensor.SensorType) ||
+			(filter.HardwareModel != "" && filter.HardwareModel != sensor.HardwareModel) ||
+			(filter.Alive != nil && *filter.Alive != response.Alive) ||
+			!sensor.isAnyTopicReadable(readable) {
+			continue
+		}
+		result = append(result, response)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SensorId < result[j].SensorId
+	})
+	return result
+}
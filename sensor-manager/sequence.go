@@ -0,0 +1,228 @@
+package sensormanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+const ApiAdminDriversPath = "/api/v1/admin/drivers"
+
+// sequence numbers are reserved in blocks, so the file is not written for every value; on a clean shutdown the last
+// numbers are written instead, only after a crash topics continue after their reserved block, which subscribers see as a gap
+const TopicSequenceReservation = 1000
+
+// by sensor and quantity
+type topicSequencesFile struct {
+	// written on shutdown, the numbers are the last ones used rather than reservations
+	Exact  bool              `json:"exact"`
+	Topics map[string]uint64 `json:"topics"`
+}
+
+// per sensor and quantity, so sequences survive topic renames
+type topicSequence struct {
+	last     uint64
+	reserved uint64
+}
+
+// numbers the values published on each topic and its variants, see codec.Value; kept next to the auth DB
+type TopicSequences struct {
+	Filename string
+	lock     sync.Mutex
+	topics   map[string]*topicSequence
+}
+
+func LoadOrCreateTopicSequences(filename string) *TopicSequences {
+	sequences := &TopicSequences{Filename: filename, topics: map[string]*topicSequence{}}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("Reading topic sequences file %s failed, creating anew.", filename)
+		err = os.MkdirAll(path.Dir(filename), 0776)
+		if err != nil {
+			log.Println(fmt.Errorf("could not create topic sequences parent directories, panic"))
+			panic(err)
+		}
+		sequences.writeToFile()
+		return sequences
+	}
+	file := topicSequencesFile{}
+	if err := json.Unmarshal(contents, &file); err != nil {
+		log.Println(fmt.Errorf("failed to unmarshal topic sequences, panic"))
+		panic(err)
+	}
+	// the next value reserves a new block either way, so a crash after it falls back to the reservation
+	for key, number := range file.Topics {
+		sequences.topics[key] = &topicSequence{last: number, reserved: number}
+	}
+	if !file.Exact {
+		log.Printf("Topic sequences file %s holds reservations, the sensor manager did not shut down cleanly; subscribers will see gaps.", filename)
+	}
+	log.Printf("Topic sequences file %s read successfully.", filename)
+	return sequences
+}
+
+// must be called with the lock held; written to a temporary file first, so a crash cannot leave a truncated one
+func (receiver *TopicSequences) writeToFile() {
+	file := topicSequencesFile{Exact: false, Topics: map[string]uint64{}}
+	for key, sequence := range receiver.topics {
+		file.Topics[key] = sequence.reserved
+	}
+	receiver.writeFile(file)
+}
+
+func (receiver *TopicSequences) writeFile(file topicSequencesFile) {
+	serialized, err := json.Marshal(file)
+	if err != nil {
+		panic(err)
+	}
+	temporary := receiver.Filename + ".tmp"
+	if err := ioutil.WriteFile(temporary, serialized, 0660); err != nil {
+		log.Println(fmt.Errorf("error writing topic sequences file"))
+		log.Println(err)
+		return
+	}
+	if err := os.Rename(temporary, receiver.Filename); err != nil {
+		log.Println(fmt.Errorf("error replacing topic sequences file"))
+		log.Println(err)
+	}
+}
+
+// writes the last numbers used on SIGTERM or SIGINT and exits; the lock stays held, so no number is handed out after
+func (receiver *TopicSequences) PersistOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	received := <-signals
+	receiver.lock.Lock()
+	file := topicSequencesFile{Exact: true, Topics: map[string]uint64{}}
+	for key, sequence := range receiver.topics {
+		file.Topics[key] = sequence.last
+	}
+	receiver.writeFile(file)
+	log.Printf("Got %s, wrote the topic sequences, exiting.", received)
+	os.Exit(0)
+}
+
+// the first value of a topic gets 1
+func (receiver *TopicSequences) next(topic SensorTopic) uint64 {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	key := buildSensorTopicKey(topic.SensorId, topic.Quantity)
+	sequence, ok := receiver.topics[key]
+	if !ok {
+		sequence = &topicSequence{}
+		receiver.topics[key] = sequence
+	}
+	sequence.last++
+	if sequence.last > sequence.reserved {
+		sequence.reserved = sequence.last + TopicSequenceReservation
+		receiver.writeToFile()
+	}
+	return sequence.last
+}
+
+// what the driver sequence numbers of incoming readings tell about one driver
+type DriverSequenceResponse struct {
+	Driver string `json:"driver"`
+	// readings with a sequence number
+	Received uint64 `json:"received"`
+	// readings whose sequence number was skipped
+	Lost uint64 `json:"lost"`
+	// sequence numbers that went back, most likely a restarted driver
+	Restarts uint64 `json:"restarts"`
+	// lost / (received + lost)
+	LossRate float64 `json:"lossRate"`
+}
+
+// tracks the optional sequence numbers drivers put in their readings, per driver and sensor;
+// readings are expected in order, as MQTT keeps the order of one connection
+type DriverSequences struct {
+	lock sync.Mutex
+	// by driver, then sensor ID
+	last    map[string]map[string]uint64
+	drivers map[string]*DriverSequenceResponse
+	metrics *Metrics
+}
+
+func NewDriverSequences(metrics *Metrics) *DriverSequences {
+	metrics.describe("sensor_manager_driver_sequenced_readings_total", "Incoming readings with a driver sequence number, per driver.")
+	metrics.describe("sensor_manager_driver_lost_readings_total", "Readings missing from the driver sequence numbers, per driver.")
+	metrics.describe("sensor_manager_driver_sequence_restarts_total", "Driver sequence numbers that went back, per driver.")
+	return &DriverSequences{
+		last:    map[string]map[string]uint64{},
+		drivers: map[string]*DriverSequenceResponse{},
+		metrics: metrics,
+	}
+}
+
+// readings without a sequence number are ignored; repeated ones, e.g. QoS 1 retries, count as received only
+func (receiver *DriverSequences) observe(reading IncomingSensorMessage) {
+	if reading.Sequence == 0 {
+		return
+	}
+	driver := getDriver(reading)
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	stats, ok := receiver.drivers[driver]
+	if !ok {
+		stats = &DriverSequenceResponse{Driver: driver}
+		receiver.drivers[driver] = stats
+		receiver.last[driver] = map[string]uint64{}
+	}
+	stats.Received++
+	receiver.metrics.incrementCounter("sensor_manager_driver_sequenced_readings_total", "driver", driver)
+	last, ok := receiver.last[driver][reading.SensorId]
+	receiver.last[driver][reading.SensorId] = reading.Sequence
+	switch {
+	case !ok || reading.Sequence == last:
+	case reading.Sequence > last+1:
+		lost := reading.Sequence - last - 1
+		logDebugf("Driver %s skipped %d readings of sensor %s.", driver, lost, reading.SensorId)
+		stats.Lost += lost
+		receiver.metrics.addToCounter(lost, "sensor_manager_driver_lost_readings_total", "driver", driver)
+	case reading.Sequence < last:
+		log.Printf("Sequence numbers of driver %s for sensor %s went back from %d to %d, assuming a restart.", driver, reading.SensorId, last, reading.Sequence)
+		stats.Restarts++
+		receiver.metrics.incrementCounter("sensor_manager_driver_sequence_restarts_total", "driver", driver)
+	}
+}
+
+// sorted by driver
+func (receiver *DriverSequences) list() []DriverSequenceResponse {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	result := []DriverSequenceResponse{}
+	for _, stats := range receiver.drivers {
+		response := *stats
+		if total := response.Received + response.Lost; total > 0 {
+			response.LossRate = float64(response.Lost) / float64(total)
+		}
+		result = append(result, response)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Driver < result[j].Driver
+	})
+	return result
+}
+
+// since the start of the sensor manager; only drivers that send sequence numbers are listed
+func handleDriverSequences(authDb *AuthDatabase, drivers *DriverSequences) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if status, err := authorizeAdmin(request, authDb); err != nil {
+			writeError(writer, request, status, err)
+			return
+		}
+		if request.Method != "GET" {
+			writeError(writer, request, 405, fmt.Errorf("method %s not allowed", request.Method))
+			return
+		}
+		writeJson(writer, request, 200, drivers.list())
+	}
+}
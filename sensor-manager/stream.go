@@ -0,0 +1,216 @@
+package sensormanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// proxies and browsers drop idle connections, so SSE streams get a comment line this often
+const StreamKeepaliveInterval = 15 * time.Second
+
+// how long a stream keeps the decision whether a topic matching one of its wildcard filters may be read
+const StreamAuthorizationCacheTime = 1 * time.Minute
+
+type streamDecision struct {
+	allowed bool
+	until   time.Time
+}
+
+// basic auth is preferred, but EventSource and WebSocket in browsers cannot set headers
+func getCredentialsFromRequest(request *http.Request) (username string, password string) {
+	if username, password, ok := request.BasicAuth(); ok {
+		return username, password
+	}
+	query := request.URL.Query()
+	return query.Get("username"), query.Get("password")
+}
+
+// without requested topics, everything the user may read is streamed; requested topics may be wildcard filters
+func buildStreamTopicFilter(authDb *AuthDatabase, username string, requestedTopics []string) (func(topic string) bool, error) {
+	if len(requestedTopics) == 0 {
+		if authDb.isSuperuserPreauthenticated(username) {
+			return func(topic string) bool { return true }, nil
+		}
+		for _, dbTopic := range authDb.copyTopics() {
+			if authDb.isAuthorized(username, dbTopic.Name, MqttAuthAccessTypeSubscribe) {
+				requestedTopics = append(requestedTopics, dbTopic.Name)
+			}
+		}
+		if len(requestedTopics) == 0 {
+			return nil, fmt.Errorf("user %s may not read any topic", username)
+		}
+	}
+
+	allowed := map[string]struct{}{}
+	filters := []string{}
+	for _, topic := range requestedTopics {
+		if !authDb.isAuthorized(username, topic, MqttAuthAccessTypeSubscribe) {
+			return nil, fmt.Errorf("user %s may not read topic %s", username, topic)
+		}
+		if isTopicFilter(topic) {
+			filters = append(filters, topic)
+		} else {
+			allowed[topic] = struct{}{}
+		}
+	}
+	// called for every value published, from several workers
+	lock := sync.Mutex{}
+	decisions := map[string]streamDecision{}
+	return func(topic string) bool {
+		if _, ok := allowed[topic]; ok {
+			return true
+		}
+		// like the broker, every topic matching a wildcard filter is checked on its own, but streams never create variants
+		for _, filter := range filters {
+			if !topicMatchesFilter(filter, topic) {
+				continue
+			}
+			now := time.Now()
+			lock.Lock()
+			decision, ok := decisions[topic]
+			if !ok || now.After(decision.until) {
+				decision = streamDecision{allowed: authDb.isAuthorizedToRead(username, topic), until: now.Add(StreamAuthorizationCacheTime)}
+				decisions[topic] = decision
+			}
+			lock.Unlock()
+			return decision.allowed
+		}
+		return false
+	}, nil
+}
+
+// writes the status code itself if the request cannot be streamed
+func authorizeStreamRequest(writer http.ResponseWriter, request *http.Request, authDb *AuthDatabase) (func(topic string) bool, bool) {
+	username, password := getCredentialsFromRequest(request)
+	if !authDb.isAuthenticated(username, password) {
+		writer.WriteHeader(401)
+		log.Printf("%s (401) -> %s", request.URL.Path, username)
+		return nil, false
+	}
+	accepts, err := buildStreamTopicFilter(authDb, username, request.URL.Query()["topic"])
+	if err != nil {
+		writer.WriteHeader(403)
+		log.Printf("%s (403) -> %s", request.URL.Path, err)
+		return nil, false
+	}
+	return accepts, true
+}
+
+func handleServerSentEvents(authDb *AuthDatabase, broadcaster *ValueBroadcaster) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		flusher, ok := writer.(http.Flusher)
+		if !ok {
+			writer.WriteHeader(500)
+			log.Printf("%s (500) -> response writer cannot flush", request.URL.Path)
+			return
+		}
+		accepts, ok := authorizeStreamRequest(writer, request, authDb)
+		if !ok {
+			return
+		}
+
+		subscription := broadcaster.subscribe(accepts)
+		defer broadcaster.unsubscribe(subscription)
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Header().Set("Cache-Control", "no-cache")
+		writer.Header().Set("Connection", "keep-alive")
+		// otherwise nginx-style proxies buffer the whole stream
+		writer.Header().Set("X-Accel-Buffering", "no")
+		writer.WriteHeader(200)
+		flusher.Flush()
+		log.Printf("%s (200) -> SSE stream opened for %s", request.URL.Path, request.RemoteAddr)
+
+		keepalive := time.NewTicker(StreamKeepaliveInterval)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-request.Context().Done():
+				log.Printf("SSE stream closed for %s.", request.RemoteAddr)
+				return
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(writer, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case message := <-subscription.messages:
+				marshaled, err := json.Marshal(message)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				if _, err := fmt.Fprintf(writer, "data: %s\n\n", marshaled); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// browsers send cached credentials along with requests of any page, so only the stream's own and the allowed origins may
+// connect; clients without an Origin header are not browsers
+func checkStreamOrigin(allowedOrigins []string) func(config *websocket.Config, request *http.Request) error {
+	return func(config *websocket.Config, request *http.Request) error {
+		origin := request.Header.Get("Origin")
+		if origin == "" {
+			return nil
+		}
+		if parsed, err := url.Parse(origin); err == nil && parsed.Host == request.Host {
+			return nil
+		}
+		for _, allowed := range allowedOrigins {
+			if origin == allowed {
+				return nil
+			}
+		}
+		log.Printf("%s (403) -> origin %s is not allowed", request.URL.Path, origin)
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+}
+
+func handleWebSocketStream(authDb *AuthDatabase, broadcaster *ValueBroadcaster, allowedOrigins []string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		accepts, ok := authorizeStreamRequest(writer, request, authDb)
+		if !ok {
+			return
+		}
+		server := websocket.Server{
+			Handshake: checkStreamOrigin(allowedOrigins),
+			Handler: func(conn *websocket.Conn) {
+				defer conn.Close()
+				subscription := broadcaster.subscribe(accepts)
+				defer broadcaster.unsubscribe(subscription)
+				log.Printf("%s (101) -> WebSocket stream opened for %s", request.URL.Path, request.RemoteAddr)
+
+				// clients are not expected to send anything, reading is only done to notice them leaving
+				closed := make(chan struct{})
+				go func() {
+					defer close(closed)
+					var ignored string
+					for websocket.Message.Receive(conn, &ignored) == nil {
+					}
+				}()
+
+				for {
+					select {
+					case <-closed:
+						log.Printf("WebSocket stream closed for %s.", request.RemoteAddr)
+						return
+					case message := <-subscription.messages:
+						if err := websocket.JSON.Send(conn, message); err != nil {
+							log.Printf("WebSocket stream for %s failed: %s", request.RemoteAddr, err)
+							return
+						}
+					}
+				}
+			},
+		}
+		server.ServeHTTP(writer, request)
+	}
+}
@@ -1,18 +1,22 @@
 package sensormanager
 
 import (
-	"encoding/json"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"mf2c-sensor-manager/codec"
 	"time"
 )
 
-func PublishMessagesIndefinitely(client mqtt.Client, topic string, interval time.Duration) {
+func PublishMessagesIndefinitely(client mqtt.Client, topic string, interval time.Duration, format codec.Format) {
 	for i := 0; true; i++ {
-		message := OutgoingClientMessage{
-			Value: float64(i),
-			Unit:  "iteration",
+		message := IncomingSensorMessage{
+			SensorId:   "sensor-simulator",
+			SensorType: "sensor-simulator",
+			Quantity:   "count",
+			Timestamp:  time.Now().Format(time.RFC3339Nano),
+			Value:      float64(i),
+			Unit:       "times",
 		}
-		marshaled, err := json.Marshal(message)
+		marshaled, err := codec.EncodeReading(format, message)
 		if err != nil {
 			panic(err)
 		}
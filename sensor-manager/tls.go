@@ -0,0 +1,162 @@
+package sensormanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type HttpServerTlsParameters struct {
+	// PEM encoded; TLS is disabled if both are empty
+	CertFile string
+	KeyFile  string
+	// PEM encoded CA bundle; if set, the admin API requires a client certificate signed by it
+	ClientCaFile string
+	// how often the files above are checked for changes
+	ReloadInterval time.Duration
+}
+
+func (receiver HttpServerTlsParameters) enabled() bool {
+	return receiver.CertFile != "" || receiver.KeyFile != ""
+}
+
+func (receiver HttpServerTlsParameters) clientCertificatesRequired() bool {
+	return receiver.ClientCaFile != ""
+}
+
+// holds the currently loaded certificate and client CA pool, swapped when the files change on disk
+type certificateReloader struct {
+	params      HttpServerTlsParameters
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	clientCas   *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+func newCertificateReloader(params HttpServerTlsParameters) (*certificateReloader, error) {
+	if params.CertFile == "" || params.KeyFile == "" {
+		return nil, fmt.Errorf("both the TLS certificate and key file must be set")
+	}
+	reloader := &certificateReloader{
+		params:   params,
+		modTimes: map[string]time.Time{},
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (receiver *certificateReloader) watchedFiles() []string {
+	files := []string{receiver.params.CertFile, receiver.params.KeyFile}
+	if receiver.params.clientCertificatesRequired() {
+		files = append(files, receiver.params.ClientCaFile)
+	}
+	return files
+}
+
+func (receiver *certificateReloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, filename := range receiver.watchedFiles() {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		modTimes[filename] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(receiver.params.CertFile, receiver.params.KeyFile)
+	if err != nil {
+		return err
+	}
+	var clientCas *x509.CertPool
+	if receiver.params.clientCertificatesRequired() {
+		contents, err := ioutil.ReadFile(receiver.params.ClientCaFile)
+		if err != nil {
+			return err
+		}
+		clientCas = x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(contents) {
+			return fmt.Errorf("no certificates found in client CA file %s", receiver.params.ClientCaFile)
+		}
+	}
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	receiver.certificate = &certificate
+	receiver.clientCas = clientCas
+	receiver.modTimes = modTimes
+	return nil
+}
+
+func (receiver *certificateReloader) changedOnDisk() bool {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	for _, filename := range receiver.watchedFiles() {
+		info, err := os.Stat(filename)
+		if err != nil {
+			// probably being replaced right now, try again next time
+			return false
+		}
+		if !info.ModTime().Equal(receiver.modTimes[filename]) {
+			return true
+		}
+	}
+	return false
+}
+
+// keeps serving the old certificate if the new one is broken
+func (receiver *certificateReloader) watch() {
+	for range time.Tick(receiver.params.ReloadInterval) {
+		if !receiver.changedOnDisk() {
+			continue
+		}
+		if err := receiver.load(); err != nil {
+			log.Printf("Reloading TLS certificates failed, keeping the old ones: %s", err)
+		} else {
+			log.Println("TLS certificates reloaded.")
+		}
+	}
+}
+
+func (receiver *certificateReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	receiver.lock.RLock()
+	defer receiver.lock.RUnlock()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*receiver.certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if receiver.clientCas != nil {
+		// not required on the TLS level, as not all endpoints need it; see requireClientCertificate
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = receiver.clientCas
+	}
+	return config, nil
+}
+
+func (receiver *certificateReloader) buildTlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: receiver.getConfigForClient,
+	}
+}
+
+// only lets requests through which presented a client certificate verified against the client CA
+func requireClientCertificate(params HttpServerTlsParameters, handler http.HandlerFunc) http.HandlerFunc {
+	if !params.clientCertificatesRequired() {
+		return handler
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+			writer.WriteHeader(403)
+			log.Printf("%s (403) -> no verified client certificate from %s", request.URL.Path, request.RemoteAddr)
+			return
+		}
+		handler(writer, request)
+	}
+}
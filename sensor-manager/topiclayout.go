@@ -0,0 +1,173 @@
+package sensormanager
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const TopicPlaceholderSensorId = "{sensorId}"
+const TopicPlaceholderQuantity = "{quantity}"
+const TopicPlaceholderHardwareModel = "{hardwareModel}"
+const TopicPlaceholderSensorType = "{sensorType}"
+
+// the flat layout from before topics were configurable
+const DefaultTopicTemplate = TopicClientPublishRoot + TopicPlaceholderSensorId
+
+// stands in for empty values, so every placeholder is one topic level
+const UnknownTopicPart = "unknown"
+
+var topicPlaceholderPattern = regexp.MustCompile(`{[^{}]*}`)
+
+// how outgoing topics are named; topics are renamed when their name changes, see resolveSensorTopic
+type TopicLayout struct {
+	Template string
+	// for how long renamed topics are still published on and readable under their old name
+	LegacyWindow time.Duration
+	// the windows subscribers can get aggregates for on <topic>/agg/<label>, see aggregate.go
+	AggregateWindows map[string]time.Duration
+	// derived topics per topic, see variants.go; further ones are denied
+	MaxVariants int
+	// variants nobody requested for this long are removed
+	VariantIdleTimeout time.Duration
+}
+
+// a name a topic had before it was renamed
+type LegacyTopicName struct {
+	Name  string    `json:"name"`
+	Until time.Time `json:"until"`
+}
+
+func validateTopicTemplate(template string) error {
+	if !strings.HasPrefix(template, "/") {
+		return fmt.Errorf("topic template %s must start with /", template)
+	}
+	if strings.ContainsAny(template, "+#") {
+		return fmt.Errorf("topic template %s must not contain wildcards", template)
+	}
+	// otherwise different sensors would share a topic
+	if !strings.Contains(template, TopicPlaceholderSensorId) {
+		return fmt.Errorf("topic template %s must contain %s", template, TopicPlaceholderSensorId)
+	}
+	for _, placeholder := range topicPlaceholderPattern.FindAllString(template, -1) {
+		switch placeholder {
+		case TopicPlaceholderSensorId, TopicPlaceholderQuantity, TopicPlaceholderHardwareModel, TopicPlaceholderSensorType:
+		default:
+			return fmt.Errorf("topic template %s contains unknown placeholder %s", template, placeholder)
+		}
+	}
+	return nil
+}
+
+// reversible, so different values never share a topic: letters, digits, - and . are kept,
+// every other byte becomes _ and two upper case hex digits (a.b stays, a/b is a_2Fb, a_b is a_5Fb)
+func encodeTopicLevel(unsafe string) string {
+	if unsafe == "" {
+		return UnknownTopicPart
+	}
+	builder := strings.Builder{}
+	for _, b := range []byte(unsafe) {
+		if ('0' <= b && b <= '9') || ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || b == '-' || b == '.' {
+			builder.WriteByte(b)
+		} else {
+			builder.WriteString(fmt.Sprintf("_%02X", b))
+		}
+	}
+	return builder.String()
+}
+
+// further quantities of a sensor get their own level if the template does not tell them apart
+func (receiver TopicLayout) buildTopicName(reading IncomingSensorMessage, firstQuantity bool) string {
+	name := strings.NewReplacer(
+		TopicPlaceholderSensorId, encodeTopicLevel(reading.SensorId),
+		TopicPlaceholderQuantity, encodeTopicLevel(reading.Quantity),
+		TopicPlaceholderHardwareModel, encodeTopicLevel(reading.HardwareModel),
+		TopicPlaceholderSensorType, encodeTopicLevel(reading.SensorType),
+	).Replace(receiver.Template)
+	if !firstQuantity && !strings.Contains(receiver.Template, TopicPlaceholderQuantity) {
+		name += "/" + encodeTopicLevel(reading.Quantity)
+	}
+	return name
+}
+
+// the current name first, then old names that are still within the deprecation window
+func (receiver SensorTopic) activeNames(now time.Time) []string {
+	names := []string{receiver.Name}
+	for _, legacy := range receiver.LegacyNames {
+		if legacy.Until.After(now) {
+			names = append(names, legacy.Name)
+		}
+	}
+	return names
+}
+
+func (receiver SensorTopic) renamed(name string, window time.Duration, now time.Time) SensorTopic {
+	legacyNames := []LegacyTopicName{}
+	for _, legacy := range append(receiver.LegacyNames, LegacyTopicName{receiver.Name, now.Add(window)}) {
+		if legacy.Until.After(now) && legacy.Name != name {
+			legacyNames = append(legacyNames, legacy)
+		}
+	}
+	receiver.Name = name
+	receiver.LegacyNames = legacyNames
+	return receiver
+}
+
+// MQTT filter matching: + matches one level, # (last) the rest
+func topicMatchesFilter(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func isTopicFilter(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// topics sharing a current or old name, e.g. from the lossy naming before encodeTopicLevel; keys are sorted
+func (db AuthDatabase) findTopicCollisions(now time.Time) map[string][]string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	owners := map[string][]string{}
+	for key, topic := range db.Topics {
+		for _, name := range topic.activeNames(now) {
+			owners[name] = append(owners[name], key)
+		}
+	}
+	collisions := map[string][]string{}
+	for name, keys := range owners {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			collisions[name] = keys
+		}
+	}
+	return collisions
+}
+
+// logs every collision; they go away once the affected sensors send again and are renamed,
+// as shared old names are not kept (see resolveSensorTopic)
+func (db AuthDatabase) ReportTopicCollisions() {
+	collisions := db.findTopicCollisions(time.Now())
+	names := []string{}
+	for name := range collisions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Topic collision: %s is shared by the auth database entries %s", name, strings.Join(collisions[name], ", "))
+	}
+	if len(names) > 0 {
+		log.Printf("Found %d topic collisions in the auth database.", len(names))
+	}
+}
@@ -0,0 +1,198 @@
+package sensormanager
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// a unit of one quantity: value in the canonical unit = value * Scale + Offset
+type unitDefinition struct {
+	Symbol string
+	Scale  float64
+	Offset float64
+	// whether SI prefixes may be put in front of the symbol (not in front of aliases)
+	Prefixable bool
+	Aliases    []string
+}
+
+type quantityDefinition struct {
+	Name string
+	// values are published in this unit
+	CanonicalUnit string
+	Aliases       []string
+	Units         []unitDefinition
+}
+
+var siPrefixes = map[string]float64{
+	"Y": 1e24, "Z": 1e21, "E": 1e18, "P": 1e15, "T": 1e12, "G": 1e9, "M": 1e6, "k": 1e3, "h": 1e2, "da": 1e1,
+	"d": 1e-1, "c": 1e-2, "m": 1e-3, "µ": 1e-6, "u": 1e-6, "n": 1e-9, "p": 1e-12, "f": 1e-15,
+}
+
+// units are looked up per quantity, so the same alias (e.g. %) may mean different things for different quantities
+var quantityDefinitions = []quantityDefinition{
+	{"temperature", "°C", nil, []unitDefinition{
+		{"°C", 1, 0, false, []string{"C", "degC", "deg C", "deg. C", "deg. celsius", "celsius", "Celsius", "℃"}},
+		{"K", 1, -273.15, true, []string{"kelvin", "Kelvin"}},
+		{"°F", 5.0 / 9.0, -32 * 5.0 / 9.0, false, []string{"F", "degF", "deg F", "deg. F", "deg. fahrenheit", "fahrenheit", "Fahrenheit", "℉"}},
+	}},
+	{"humidity", "%RH", []string{"relative humidity"}, []unitDefinition{
+		{"%RH", 1, 0, false, []string{"RH%", "%", "percent"}},
+	}},
+	{"mass", "kg", []string{"weight"}, []unitDefinition{
+		{"g", 1e-3, 0, true, []string{"gram", "grams"}},
+		{"t", 1e3, 0, false, []string{"tonne", "tonnes"}},
+		{"lb", 0.45359237, 0, false, []string{"lbs", "pound", "pounds"}},
+		{"oz", 0.028349523125, 0, false, []string{"ounce", "ounces"}},
+	}},
+	{"length", "m", []string{"distance"}, []unitDefinition{
+		{"m", 1, 0, true, []string{"meter", "meters", "metre", "metres"}},
+		{"in", 0.0254, 0, false, []string{"inch", "inches"}},
+		{"ft", 0.3048, 0, false, []string{"foot", "feet"}},
+		{"mi", 1609.344, 0, false, []string{"mile", "miles"}},
+	}},
+	{"pressure", "Pa", nil, []unitDefinition{
+		{"Pa", 1, 0, true, []string{"pascal"}},
+		{"bar", 1e5, 0, true, nil},
+		{"atm", 101325, 0, false, nil},
+		{"psi", 6894.757293168, 0, false, nil},
+		{"mmHg", 133.322387415, 0, false, []string{"torr", "Torr"}},
+	}},
+	{"time", "s", []string{"duration"}, []unitDefinition{
+		{"s", 1, 0, true, []string{"sec", "second", "seconds"}},
+		{"min", 60, 0, false, []string{"minute", "minutes"}},
+		{"h", 3600, 0, false, []string{"hour", "hours"}},
+	}},
+	{"voltage", "V", nil, []unitDefinition{{"V", 1, 0, true, []string{"volt", "volts"}}}},
+	{"current", "A", nil, []unitDefinition{{"A", 1, 0, true, []string{"ampere", "amperes", "amp", "amps"}}}},
+	{"power", "W", nil, []unitDefinition{{"W", 1, 0, true, []string{"watt", "watts"}}}},
+	{"energy", "J", nil, []unitDefinition{
+		{"J", 1, 0, true, []string{"joule", "joules"}},
+		{"Wh", 3600, 0, true, nil},
+	}},
+	{"frequency", "Hz", nil, []unitDefinition{{"Hz", 1, 0, true, []string{"hertz"}}}},
+	{"speed", "m/s", []string{"velocity"}, []unitDefinition{
+		{"m/s", 1, 0, false, nil},
+		{"km/h", 1 / 3.6, 0, false, []string{"kph"}},
+		{"mph", 0.44704, 0, false, nil},
+		{"kn", 0.514444444, 0, false, []string{"knot", "knots"}},
+	}},
+	{"acceleration", "m/s²", nil, []unitDefinition{
+		{"m/s²", 1, 0, false, []string{"m/s^2", "m/s2"}},
+		{"gn", 9.80665, 0, false, []string{"g0", "G"}},
+	}},
+	{"angular velocity", "rad/s", []string{"angular-velocity", "angular_velocity"}, []unitDefinition{
+		{"rad/s", 1, 0, false, nil},
+		{"°/s", math.Pi / 180, 0, false, []string{"deg/s", "dps"}},
+		{"rpm", 2 * math.Pi / 60, 0, false, nil},
+	}},
+	{"illuminance", "lx", nil, []unitDefinition{{"lx", 1, 0, true, []string{"lux"}}}},
+	{"concentration", "ppm", nil, []unitDefinition{
+		{"ppm", 1, 0, false, nil},
+		{"ppb", 1e-3, 0, false, nil},
+		{"%", 1e4, 0, false, []string{"percent"}},
+	}},
+	{"count", "1", []string{"example-count"}, []unitDefinition{{"1", 1, 0, false, []string{"times", "count", "counts", "pcs"}}}},
+}
+
+// a unit resolved for one quantity, including its prefix
+type resolvedUnit struct {
+	Quantity *quantityDefinition
+	Symbol   string
+	Scale    float64
+	Offset   float64
+}
+
+func (receiver resolvedUnit) toCanonical(value float64) float64 {
+	return value*receiver.Scale + receiver.Offset
+}
+
+func (receiver resolvedUnit) fromCanonical(value float64) float64 {
+	return (value - receiver.Offset) / receiver.Scale
+}
+
+var quantityLookup = buildQuantityLookup()
+
+func buildQuantityLookup() map[string]*quantityDefinition {
+	lookup := map[string]*quantityDefinition{}
+	for i := range quantityDefinitions {
+		quantity := &quantityDefinitions[i]
+		for _, name := range append([]string{quantity.Name}, quantity.Aliases...) {
+			lookup[strings.ToLower(name)] = quantity
+		}
+	}
+	return lookup
+}
+
+func lookupQuantity(name string) (*quantityDefinition, bool) {
+	quantity, ok := quantityLookup[strings.ToLower(strings.TrimSpace(name))]
+	return quantity, ok
+}
+
+func isSameQuantity(left string, right string) bool {
+	leftQuantity, leftOk := lookupQuantity(left)
+	rightQuantity, rightOk := lookupQuantity(right)
+	if !leftOk || !rightOk {
+		return left == right
+	}
+	return leftQuantity == rightQuantity
+}
+
+// symbols and aliases first, then prefixed symbols; units are case sensitive (mPa is not MPa)
+func (receiver *quantityDefinition) resolveUnit(unit string) (resolvedUnit, bool) {
+	unit = strings.TrimSpace(unit)
+	for _, definition := range receiver.Units {
+		for _, name := range append([]string{definition.Symbol}, definition.Aliases...) {
+			if name == unit {
+				return resolvedUnit{receiver, definition.Symbol, definition.Scale, definition.Offset}, true
+			}
+		}
+	}
+	for prefix, factor := range siPrefixes {
+		if !strings.HasPrefix(unit, prefix) {
+			continue
+		}
+		for _, definition := range receiver.Units {
+			if definition.Prefixable && definition.Symbol == strings.TrimPrefix(unit, prefix) {
+				return resolvedUnit{receiver, prefix + definition.Symbol, definition.Scale * factor, definition.Offset}, true
+			}
+		}
+	}
+	return resolvedUnit{}, false
+}
+
+func (receiver *quantityDefinition) unitSymbols() []string {
+	symbols := []string{}
+	for _, definition := range receiver.Units {
+		symbols = append(symbols, definition.Symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// brings quantity, unit and value into canonical form; unknown quantities and units are rejected
+func normalizeIncomingMessage(incoming IncomingSensorMessage) (IncomingSensorMessage, *MessageRejection) {
+	quantity, ok := lookupQuantity(incoming.Quantity)
+	if !ok {
+		return incoming, reject(RejectionUnknownQuantity, "quantity %s of sensor %s is unknown", incoming.Quantity, incoming.SensorId)
+	}
+	unit, ok := quantity.resolveUnit(incoming.Unit)
+	if !ok {
+		for i := range quantityDefinitions {
+			if _, ok := quantityDefinitions[i].resolveUnit(incoming.Unit); ok {
+				return incoming, reject(RejectionUnitQuantityMismatch, "unit %s of sensor %s is not one of quantity %s, but of %s",
+					incoming.Unit, incoming.SensorId, quantity.Name, quantityDefinitions[i].Name)
+			}
+		}
+		return incoming, reject(RejectionUnknownUnit, "unit %s of sensor %s is unknown, %s takes %s (with SI prefixes where sensible)",
+			incoming.Unit, incoming.SensorId, quantity.Name, strings.Join(quantity.unitSymbols(), ", "))
+	}
+	normalized := incoming
+	normalized.Quantity = quantity.Name
+	normalized.Unit = quantity.CanonicalUnit
+	normalized.Value = unit.toCanonical(incoming.Value)
+	if math.IsNaN(normalized.Value) || math.IsInf(normalized.Value, 0) {
+		return incoming, reject(RejectionNonFiniteValue, "value %f %s of sensor %s is not finite in %s", incoming.Value, incoming.Unit, incoming.SensorId, quantity.CanonicalUnit)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,111 @@
+package sensormanager
+
+import (
+	"fmt"
+	"math"
+	"mf2c-sensor-manager/codec"
+	"strings"
+	"time"
+)
+
+// machine-readable, used as metric labels
+type RejectionReason string
+
+const (
+	RejectionMalformedPayload     RejectionReason = "malformed-payload"
+	RejectionUnknownField         RejectionReason = "unknown-field"
+	RejectionMissingSensorId      RejectionReason = "missing-sensor-id"
+	RejectionMissingQuantity      RejectionReason = "missing-quantity"
+	RejectionMissingUnit          RejectionReason = "missing-unit"
+	RejectionMissingTimestamp     RejectionReason = "missing-timestamp"
+	RejectionInvalidTimestamp     RejectionReason = "invalid-timestamp"
+	RejectionTimestampInFuture    RejectionReason = "timestamp-in-future"
+	RejectionTimestampTooOld      RejectionReason = "timestamp-too-old"
+	RejectionNonFiniteValue       RejectionReason = "non-finite-value"
+	RejectionUnitQuantityMismatch RejectionReason = "unit-quantity-mismatch"
+	RejectionUnknownQuantity      RejectionReason = "unknown-quantity"
+	RejectionUnknownUnit          RejectionReason = "unknown-unit"
+	RejectionMixedMeasurements    RejectionReason = "mixed-measurements"
+	RejectionDuplicateQuantity    RejectionReason = "duplicate-quantity"
+	RejectionEmptyBatch           RejectionReason = "empty-batch"
+	RejectionBatchTooLarge        RejectionReason = "batch-too-large"
+	RejectionVirtualSensor        RejectionReason = "virtual-sensor"
+	RejectionInvalidSensorId      RejectionReason = "invalid-sensor-id"
+	RejectionUnresolvedTopic      RejectionReason = "unresolved-topic"
+)
+
+// # separates sensor ID and quantity in topic keys, see buildSensorTopicKey; + and / are MQTT topic syntax
+const InvalidSensorIdCharacters = "#+/"
+
+// used for rejections where the driver cannot be told from the message
+const UnknownDriver = "unknown"
+
+type MessageRejection struct {
+	Reason RejectionReason
+	Detail string
+}
+
+func (receiver *MessageRejection) Error() string {
+	return fmt.Sprintf("%s: %s", receiver.Reason, receiver.Detail)
+}
+
+func reject(reason RejectionReason, format string, v ...interface{}) *MessageRejection {
+	return &MessageRejection{Reason: reason, Detail: fmt.Sprintf(format, v...)}
+}
+
+// limits for incoming messages, zero disables a check
+type ValidationLimits struct {
+	MaxFutureSkew time.Duration
+	MaxAge        time.Duration
+	// readings per batch, zero means no limit
+	MaxBatchSize int
+}
+
+func getDriver(incoming IncomingSensorMessage) string {
+	if incoming.HardwareModel == "" {
+		return UnknownDriver
+	}
+	return incoming.HardwareModel
+}
+
+// unknown fields are rejected, as they most likely are typos of optional fields
+func decodeErrorRejection(err error) *MessageRejection {
+	if _, ok := err.(*codec.UnknownFieldError); ok {
+		return reject(RejectionUnknownField, "%s", err)
+	}
+	return reject(RejectionMalformedPayload, "%s", err)
+}
+
+func validateIncomingMessage(incoming IncomingSensorMessage, limits ValidationLimits, now time.Time) *MessageRejection {
+	if strings.TrimSpace(incoming.SensorId) == "" {
+		return reject(RejectionMissingSensorId, "the sensor ID must not be empty")
+	}
+	if strings.ContainsAny(incoming.SensorId, InvalidSensorIdCharacters) {
+		return reject(RejectionInvalidSensorId, "sensor ID %s must not contain any of %s", incoming.SensorId, InvalidSensorIdCharacters)
+	}
+	if strings.TrimSpace(incoming.Quantity) == "" {
+		return reject(RejectionMissingQuantity, "the quantity of sensor %s must not be empty", incoming.SensorId)
+	}
+	if strings.TrimSpace(incoming.Unit) == "" {
+		return reject(RejectionMissingUnit, "the unit of sensor %s must not be empty", incoming.SensorId)
+	}
+	if math.IsNaN(incoming.Value) || math.IsInf(incoming.Value, 0) {
+		return reject(RejectionNonFiniteValue, "value %f of sensor %s is not finite", incoming.Value, incoming.SensorId)
+	}
+
+	if incoming.Timestamp == "" {
+		return reject(RejectionMissingTimestamp, "the timestamp of sensor %s must not be empty", incoming.SensorId)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, incoming.Timestamp)
+	if err != nil {
+		return reject(RejectionInvalidTimestamp, "timestamp %s of sensor %s is not RFC 3339", incoming.Timestamp, incoming.SensorId)
+	}
+	if limits.MaxFutureSkew > 0 && timestamp.Sub(now) > limits.MaxFutureSkew {
+		return reject(RejectionTimestampInFuture, "timestamp %s of sensor %s is more than %s in the future", incoming.Timestamp, incoming.SensorId, limits.MaxFutureSkew)
+	}
+	if limits.MaxAge > 0 && now.Sub(timestamp) > limits.MaxAge {
+		return reject(RejectionTimestampTooOld, "timestamp %s of sensor %s is more than %s in the past", incoming.Timestamp, incoming.SensorId, limits.MaxAge)
+	}
+	// units and quantities are checked when normalizing, see units.go
+	return nil
+}
@@ -0,0 +1,171 @@
+package sensormanager
+
+import (
+	"fmt"
+	"log"
+	"mf2c-sensor-manager/codec"
+	"strings"
+	"time"
+)
+
+// derived topics below a sensor topic, e.g. /sensor-manager/values/<id>/in/°F or .../<id>/batch/fmt/cbor/in/°F
+// in/<unit> has to come last, as units may contain slashes (km/h)
+const TopicVariantUnit = "in"
+const TopicVariantBatch = "batch"
+const TopicVariantFormat = "fmt"
+const TopicVariantAggregate = "agg"
+
+// how often variants nobody requested for the layout's idle timeout are removed, see AuthDatabase.removeIdleVariants
+const TopicVariantIdleCheckInterval = 1 * time.Minute
+
+// how the values of a derived topic differ from those of its base topic
+type TopicVariant struct {
+	// empty for the canonical unit
+	Unit resolvedUnit
+	// an array per incoming message instead of one message per reading, see batch.go
+	Batch bool
+	// the payload format, JSON if not set
+	Format codec.Format
+	// one AggregateClientMessage per window instead of the values, zero if not aggregated; see aggregate.go
+	AggregateWindow time.Duration
+	// the values with their provenance, see envelope.go
+	Envelope bool
+}
+
+// aggregate windows are those of the layout
+func (receiver TopicLayout) parseTopicVariant(quantityName string, suffix string) (TopicVariant, error) {
+	variant := TopicVariant{Format: codec.FormatJson}
+	formatSet := false
+	segments := strings.Split(suffix, "/")
+	for i := 0; i < len(segments); i++ {
+		switch segments[i] {
+		case TopicVariantUnit:
+			quantity, ok := lookupQuantity(quantityName)
+			if !ok {
+				return variant, fmt.Errorf("quantity %s is unknown", quantityName)
+			}
+			unitName := strings.Join(segments[i+1:], "/")
+			unit, ok := quantity.resolveUnit(unitName)
+			if !ok {
+				return variant, fmt.Errorf("unit %s is not one of quantity %s", unitName, quantity.Name)
+			}
+			variant.Unit = unit
+			i = len(segments)
+		case TopicVariantBatch:
+			if variant.Batch {
+				return variant, fmt.Errorf("topic variant %s repeats %s", suffix, TopicVariantBatch)
+			}
+			variant.Batch = true
+		case TopicVariantFormat:
+			if formatSet || i+1 >= len(segments) {
+				return variant, fmt.Errorf("topic variant %s needs exactly one %s/<format>", suffix, TopicVariantFormat)
+			}
+			format, err := codec.ParseFormat(segments[i+1])
+			if err != nil {
+				return variant, err
+			}
+			variant.Format, formatSet = format, true
+			i++
+		case TopicVariantAggregate:
+			if variant.AggregateWindow != 0 || i+1 >= len(segments) {
+				return variant, fmt.Errorf("topic variant %s needs exactly one %s/<window>", suffix, TopicVariantAggregate)
+			}
+			window, ok := receiver.AggregateWindows[segments[i+1]]
+			if !ok {
+				return variant, fmt.Errorf("aggregate window %s is not configured", segments[i+1])
+			}
+			variant.AggregateWindow = window
+			i++
+		case TopicVariantEnvelope:
+			if variant.Envelope {
+				return variant, fmt.Errorf("topic variant %s repeats %s", suffix, TopicVariantEnvelope)
+			}
+			variant.Envelope = true
+		default:
+			return variant, fmt.Errorf("unknown topic variant %s", suffix)
+		}
+	}
+	if variant.AggregateWindow != 0 && (variant.Batch || variant.Format != codec.FormatJson) {
+		return variant, fmt.Errorf("topic variant %s: aggregates are published as JSON and not batched", suffix)
+	}
+	if variant.Envelope && (variant.AggregateWindow != 0 || variant.Format == codec.FormatSenmlJson || variant.Format == codec.FormatSenmlCbor) {
+		return variant, fmt.Errorf("topic variant %s: aggregates and SenML records have no %s envelope", suffix, TopicVariantEnvelope)
+	}
+	return variant, nil
+}
+
+// the longest sensor topic the given topic is a valid variant of, with Name set to the matching (possibly old) name
+func (db AuthDatabase) findVariantBase(topic string) (base SensorTopic, suffix string, ok bool) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	now := time.Now()
+	for _, dbTopic := range db.Topics {
+		for _, name := range dbTopic.activeNames(now) {
+			if !strings.HasPrefix(topic, name+"/") || len(name) <= len(base.Name) {
+				continue
+			}
+			candidate := strings.TrimPrefix(topic, name+"/")
+			if _, err := db.layout.parseTopicVariant(dbTopic.Quantity, candidate); err == nil {
+				base, suffix, ok = dbTopic, candidate, true
+				base.Name = name
+			}
+		}
+	}
+	return
+}
+
+func (receiver TopicVariant) apply(message OutgoingClientMessage) OutgoingClientMessage {
+	if !receiver.Envelope {
+		message.Provenance = nil
+	}
+	if receiver.Unit.Quantity != nil {
+		message.Value = receiver.Unit.fromCanonical(message.Value)
+		if message.RawValue != nil {
+			rawValue := receiver.Unit.fromCanonical(*message.RawValue)
+			message.RawValue = &rawValue
+		}
+		message.Unit = receiver.Unit.Symbol
+	}
+	return message
+}
+
+// variants stay until nobody has requested them for the layout's idle timeout, see AuthDatabase.removeIdleVariants
+// they are published below old names of the topic as well; batch and aggregate variants are only collected here
+// the message has its provenance set, variants other than v2 leave it out
+func publishTopicVariants(publisher *Publisher, broadcaster *ValueBroadcaster, batches *outgoingBatches, aggregates *outgoingAggregates, layout TopicLayout,
+	topic SensorTopic, policy PublishPolicy, message OutgoingClientMessage) {
+	for _, suffix := range topic.Variants {
+		variant, err := layout.parseTopicVariant(topic.Quantity, suffix)
+		if err != nil {
+			log.Printf("Skipping variant %s/%s: %s", topic.Name, suffix, err)
+			continue
+		}
+		converted := variant.apply(message)
+		if variant.AggregateWindow != 0 {
+			aggregates.add(publisher, topic, suffix, variant.AggregateWindow, policy, converted)
+			continue
+		}
+		// SenML records are named like incoming ones, see the codec package
+		recordName := topic.SensorId + ":" + topic.Quantity
+		if variant.Batch {
+			for _, name := range topic.activeNames(time.Now()) {
+				batches.add(name+"/"+suffix, policy, variant.Format, recordName, converted)
+			}
+			continue
+		}
+		encoded, err := codec.EncodeValue(variant.Format, recordName, converted)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, name := range topic.activeNames(time.Now()) {
+			variantTopicName := name + "/" + suffix
+			publisher.publish(variantTopicName, policy, encoded)
+			// streams are JSON anyway
+			if variant.Format != codec.FormatJson {
+				continue
+			}
+			broadcaster.publish(variantTopicName, converted)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package sensormanager
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what virtual sensors report as sensor type
+const VirtualSensorType = "virtual"
+
+// a sensor computed from the readings of others; the inputs are in the canonical units of their quantities
+type VirtualSensorDefinition struct {
+	SensorId string `yaml:"sensorId"`
+	Quantity string `yaml:"quantity"`
+	// of the expression's result, the canonical unit of the quantity if not set
+	Unit string `yaml:"unit"`
+	// by the name used in the expression
+	Inputs map[string]VirtualSensorInput `yaml:"inputs"`
+	// arithmetic on the inputs with + - * / and the functions in virtualSensorFunctions, e.g. dewPoint(t, h) or avg(a, b, c, d)
+	Expression string `yaml:"expression"`
+	// no value is computed while an input is older than this compared to the newest one; 0 disables the check
+	MaxInputAgeSeconds int `yaml:"maxInputAgeSeconds"`
+}
+
+type VirtualSensorInput struct {
+	SensorId string `yaml:"sensorId"`
+	Quantity string `yaml:"quantity"`
+}
+
+// Magnus formula, temperature in °C and relative humidity in %RH
+func dewPoint(temperature float64, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+	gamma := math.Log(humidity/100) + b*temperature/(c+temperature)
+	return c * gamma / (b - gamma)
+}
+
+type virtualSensorFunction struct {
+	// -1 for any number, at least one
+	arity int
+	call  func(arguments []float64) float64
+}
+
+var virtualSensorFunctions = map[string]virtualSensorFunction{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"ln":    {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min": {-1, func(a []float64) float64 {
+		result := a[0]
+		for _, value := range a[1:] {
+			result = math.Min(result, value)
+		}
+		return result
+	}},
+	"max": {-1, func(a []float64) float64 {
+		result := a[0]
+		for _, value := range a[1:] {
+			result = math.Max(result, value)
+		}
+		return result
+	}},
+	"avg": {-1, func(a []float64) float64 {
+		sum := 0.0
+		for _, value := range a {
+			sum += value
+		}
+		return sum / float64(len(a))
+	}},
+	"dewPoint": {2, func(a []float64) float64 { return dewPoint(a[0], a[1]) }},
+}
+
+// Go expression syntax, restricted to numbers, the inputs, arithmetic and the functions
+func compileVirtualSensorExpression(expression string, inputs map[string]VirtualSensorInput) (ast.Expr, error) {
+	parsed, err := parser.ParseExpr(expression)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse expression '%s': %s", expression, err)
+	}
+	var check func(node ast.Expr) error
+	check = func(node ast.Expr) error {
+		switch node := node.(type) {
+		case *ast.BasicLit:
+			_, err := parseVirtualSensorNumber(node)
+			return err
+		case *ast.Ident:
+			if _, ok := inputs[node.Name]; !ok {
+				return fmt.Errorf("%s is not an input", node.Name)
+			}
+		case *ast.ParenExpr:
+			return check(node.X)
+		case *ast.UnaryExpr:
+			if node.Op != token.SUB && node.Op != token.ADD {
+				return fmt.Errorf("operator %s is not supported", node.Op)
+			}
+			return check(node.X)
+		case *ast.BinaryExpr:
+			switch node.Op {
+			case token.ADD, token.SUB, token.MUL, token.QUO:
+			default:
+				return fmt.Errorf("operator %s is not supported", node.Op)
+			}
+			if err := check(node.X); err != nil {
+				return err
+			}
+			return check(node.Y)
+		case *ast.CallExpr:
+			name, ok := node.Fun.(*ast.Ident)
+			if !ok {
+				return fmt.Errorf("only the functions %s can be called", strings.Join(virtualSensorFunctionNames(), ", "))
+			}
+			function, ok := virtualSensorFunctions[name.Name]
+			if !ok {
+				return fmt.Errorf("unknown function %s, must be one of %s", name.Name, strings.Join(virtualSensorFunctionNames(), ", "))
+			}
+			if (function.arity >= 0 && len(node.Args) != function.arity) || len(node.Args) == 0 || node.Ellipsis.IsValid() {
+				return fmt.Errorf("wrong number of arguments for %s", name.Name)
+			}
+			for _, argument := range node.Args {
+				if err := check(argument); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported syntax in expression '%s'", expression)
+		}
+		return nil
+	}
+	if err := check(parsed); err != nil {
+		return nil, fmt.Errorf("expression '%s': %s", expression, err)
+	}
+	return parsed, nil
+}
+
+// decimal numbers only; Go also has literals like 0x10, 010 (octal) or 1_000, which are rejected rather than misread
+func parseVirtualSensorNumber(node *ast.BasicLit) (float64, error) {
+	if node.Kind != token.INT && node.Kind != token.FLOAT {
+		return 0, fmt.Errorf("%s is not a number", node.Value)
+	}
+	isOctal := node.Kind == token.INT && len(node.Value) > 1 && node.Value[0] == '0'
+	value, err := strconv.ParseFloat(node.Value, 64)
+	if err != nil || isOctal || strings.ContainsAny(node.Value, "xXoObB_") {
+		return 0, fmt.Errorf("%s is not a decimal number", node.Value)
+	}
+	return value, nil
+}
+
+func virtualSensorFunctionNames() []string {
+	names := []string{}
+	for name := range virtualSensorFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the expression has been checked by compileVirtualSensorExpression
+func evaluateVirtualSensorExpression(node ast.Expr, values map[string]float64) (float64, error) {
+	switch node := node.(type) {
+	case *ast.BasicLit:
+		return parseVirtualSensorNumber(node)
+	case *ast.Ident:
+		return values[node.Name], nil
+	case *ast.ParenExpr:
+		return evaluateVirtualSensorExpression(node.X, values)
+	case *ast.UnaryExpr:
+		value, err := evaluateVirtualSensorExpression(node.X, values)
+		if node.Op == token.SUB {
+			return -value, err
+		}
+		return value, err
+	case *ast.BinaryExpr:
+		left, err := evaluateVirtualSensorExpression(node.X, values)
+		if err != nil {
+			return 0, err
+		}
+		right, err := evaluateVirtualSensorExpression(node.Y, values)
+		if err != nil {
+			return 0, err
+		}
+		switch node.Op {
+		case token.ADD:
+			return left + right, nil
+		case token.SUB:
+			return left - right, nil
+		case token.MUL:
+			return left * right, nil
+		case token.QUO:
+			return left / right, nil
+		}
+	case *ast.CallExpr:
+		arguments := []float64{}
+		for _, argument := range node.Args {
+			value, err := evaluateVirtualSensorExpression(argument, values)
+			if err != nil {
+				return 0, err
+			}
+			arguments = append(arguments, value)
+		}
+		return virtualSensorFunctions[node.Fun.(*ast.Ident).Name].call(arguments), nil
+	}
+	return 0, fmt.Errorf("unsupported syntax")
+}
+
+// inputs must be real sensors, so virtual sensors cannot depend on each other in cycles
+func validateVirtualSensors(definitions []VirtualSensorDefinition) []string {
+	problems := []string{}
+	virtualIds := map[string]bool{}
+	for _, definition := range definitions {
+		if definition.SensorId == "" {
+			problems = append(problems, "a virtual sensor has no sensor ID")
+		}
+		if strings.ContainsAny(definition.SensorId, InvalidSensorIdCharacters) {
+			problems = append(problems, fmt.Sprintf("virtual sensor ID %s must not contain any of %s", definition.SensorId, InvalidSensorIdCharacters))
+		}
+		if virtualIds[definition.SensorId] {
+			problems = append(problems, fmt.Sprintf("virtual sensor %s is defined more than once", definition.SensorId))
+		}
+		virtualIds[definition.SensorId] = true
+	}
+	for _, definition := range definitions {
+		quantity, ok := lookupQuantity(definition.Quantity)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("virtual sensor %s: unknown quantity %s", definition.SensorId, definition.Quantity))
+		} else if _, ok := quantity.resolveUnit(definition.Unit); definition.Unit != "" && !ok {
+			problems = append(problems, fmt.Sprintf("virtual sensor %s: unit %s is not one of quantity %s", definition.SensorId, definition.Unit, quantity.Name))
+		}
+		if len(definition.Inputs) == 0 {
+			problems = append(problems, fmt.Sprintf("virtual sensor %s has no inputs", definition.SensorId))
+		}
+		for name, input := range definition.Inputs {
+			if _, ok := lookupQuantity(input.Quantity); !ok {
+				problems = append(problems, fmt.Sprintf("virtual sensor %s: input %s has unknown quantity %s", definition.SensorId, name, input.Quantity))
+			}
+			if virtualIds[input.SensorId] {
+				problems = append(problems, fmt.Sprintf("virtual sensor %s: input %s is virtual sensor %s", definition.SensorId, name, input.SensorId))
+			}
+		}
+		if _, err := compileVirtualSensorExpression(definition.Expression, definition.Inputs); err != nil {
+			problems = append(problems, fmt.Sprintf("virtual sensor %s: %s", definition.SensorId, err))
+		}
+		if definition.MaxInputAgeSeconds < 0 {
+			problems = append(problems, fmt.Sprintf("virtual sensor %s: max input age must not be negative", definition.SensorId))
+		}
+	}
+	return problems
+}
+
+type virtualInputValue struct {
+	value      float64
+	measuredAt time.Time
+}
+
+type virtualSensor struct {
+	definition VirtualSensorDefinition
+	expression ast.Expr
+	// by input name, the latest reading of each
+	values map[string]virtualInputValue
+	// the newest input timestamp of the last result
+	computedAt time.Time
+}
+
+type virtualSensorInputRef struct {
+	sensor *virtualSensor
+	name   string
+}
+
+// computes the virtual sensors as their inputs arrive; results go through the pipeline like readings of real sensors
+type VirtualSensors struct {
+	lock    sync.Mutex
+	byId    map[string]*virtualSensor
+	byInput map[string][]virtualSensorInputRef
+	metrics *Metrics
+}
+
+// the definitions are validated beforehand
+func NewVirtualSensors(definitions []VirtualSensorDefinition, metrics *Metrics) *VirtualSensors {
+	metrics.describe("sensor_manager_virtual_sensor_skips_total", "Updates of virtual sensors that produced no value, per virtual sensor and reason (missing-input, stale-input, non-finite-value).")
+	sensors := &VirtualSensors{
+		byId:    map[string]*virtualSensor{},
+		byInput: map[string][]virtualSensorInputRef{},
+		metrics: metrics,
+	}
+	for _, definition := range definitions {
+		expression, _ := compileVirtualSensorExpression(definition.Expression, definition.Inputs)
+		sensor := &virtualSensor{definition: definition, expression: expression, values: map[string]virtualInputValue{}}
+		sensors.byId[definition.SensorId] = sensor
+		for name, input := range definition.Inputs {
+			quantity, _ := lookupQuantity(input.Quantity)
+			key := buildSensorTopicKey(input.SensorId, quantity.Name)
+			sensors.byInput[key] = append(sensors.byInput[key], virtualSensorInputRef{sensor, name})
+		}
+	}
+	return sensors
+}
+
+func (receiver *VirtualSensors) isVirtual(sensorId string) bool {
+	_, ok := receiver.byId[sensorId]
+	return ok
+}
+
+func (receiver *VirtualSensors) skip(sensor *virtualSensor, reason string, format string, v ...interface{}) {
+	logDebugf("Virtual sensor %s: "+format, append([]interface{}{sensor.definition.SensorId}, v...)...)
+	receiver.metrics.incrementCounter("sensor_manager_virtual_sensor_skips_total", "sensor", sensor.definition.SensorId, "reason", reason)
+}
+
+// the readings of the virtual sensors that use any of the given normalized readings, one per virtual sensor,
+// timestamped like their newest input; nothing is computed unless the newest input is newer than the last result
+func (receiver *VirtualSensors) update(readings []IncomingSensorMessage) []IncomingSensorMessage {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	updated := []*virtualSensor{}
+	for _, reading := range readings {
+		measuredAt, err := time.Parse(time.RFC3339Nano, reading.Timestamp)
+		if err != nil {
+			continue
+		}
+		for _, ref := range receiver.byInput[buildSensorTopicKey(reading.SensorId, reading.Quantity)] {
+			sensor := ref.sensor
+			if previous, ok := sensor.values[ref.name]; ok && previous.measuredAt.After(measuredAt) {
+				continue
+			}
+			sensor.values[ref.name] = virtualInputValue{reading.Value, measuredAt}
+			updated = append(updated, sensor)
+		}
+	}
+	results := []IncomingSensorMessage{}
+	computed := map[*virtualSensor]bool{}
+	for _, sensor := range updated {
+		if computed[sensor] {
+			continue
+		}
+		computed[sensor] = true
+		if result, ok := receiver.compute(sensor); ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// must be called with the lock held
+func (receiver *VirtualSensors) compute(sensor *virtualSensor) (IncomingSensorMessage, bool) {
+	definition := sensor.definition
+	newest := time.Time{}
+	for _, input := range sensor.values {
+		if input.measuredAt.After(newest) {
+			newest = input.measuredAt
+		}
+	}
+	if !newest.After(sensor.computedAt) {
+		logDebugf("Virtual sensor %s already has a value for %s.", definition.SensorId, newest.Format(time.RFC3339Nano))
+		return IncomingSensorMessage{}, false
+	}
+	values := map[string]float64{}
+	for name := range definition.Inputs {
+		input, ok := sensor.values[name]
+		if !ok {
+			receiver.skip(sensor, "missing-input", "input %s has no value yet", name)
+			return IncomingSensorMessage{}, false
+		}
+		maxAge := time.Duration(definition.MaxInputAgeSeconds) * time.Second
+		if maxAge > 0 && newest.Sub(input.measuredAt) > maxAge {
+			receiver.skip(sensor, "stale-input", "input %s is from %s, more than %s before the newest input", name, input.measuredAt.Format(time.RFC3339), maxAge)
+			return IncomingSensorMessage{}, false
+		}
+		values[name] = input.value
+	}
+	quantity, _ := lookupQuantity(definition.Quantity)
+	unit := definition.Unit
+	if unit == "" {
+		unit = quantity.CanonicalUnit
+	}
+	value, err := evaluateVirtualSensorExpression(sensor.expression, values)
+	if err != nil {
+		receiver.skip(sensor, "invalid-expression", "the expression cannot be evaluated: %s", err)
+		return IncomingSensorMessage{}, false
+	}
+	result, rejection := normalizeIncomingMessage(IncomingSensorMessage{
+		SensorId:   definition.SensorId,
+		SensorType: VirtualSensorType,
+		Quantity:   quantity.Name,
+		Timestamp:  newest.UTC().Format(time.RFC3339Nano),
+		Value:      value,
+		Unit:       unit,
+	})
+	if rejection != nil || math.IsNaN(result.Value) || math.IsInf(result.Value, 0) {
+		receiver.skip(sensor, "non-finite-value", "the expression has no finite value for %v", values)
+		return IncomingSensorMessage{}, false
+	}
+	sensor.computedAt = newest
+	return result, true
+}